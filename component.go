@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"net"
+	"sync/atomic"
 )
 
 type Config struct {
@@ -46,6 +47,14 @@ type Cipher interface {
 	Overhead() int
 }
 
+// PeerCipher is a Cipher which keeps a session with every peer, like a cipher with a handshake.
+// The datagram links encrypt and decrypt the packets of a peer by EncryptTo and DecryptFrom.
+type PeerCipher interface {
+	Cipher
+	EncryptTo(packet []byte, dst LinkAddr) []byte
+	DecryptFrom(packet []byte, src LinkAddr) ([]byte, error)
+}
+
 // LinkAddr is something like MAC address.
 // It is used as map keys,
 // so it must be comparable and equality means equality.
@@ -57,6 +66,8 @@ type LinkAddr interface{}
 type Link interface {
 	// Send the packet through the Link via dst.
 	// This method is called on the main event loop, so it must be non-blocking.
+	// A datagram link may call it from its own goroutines too, for keepalives,
+	// then it must be safe for concurrent use.
 	Send(packet []byte, dst LinkAddr) error
 	// Receive a packet from the Link.
 	// buffer is a []byte whose length is 2048.
@@ -75,6 +86,83 @@ type Link interface {
 	// This will be called when either Send or Recv returns a non-nil error.
 	Cancel()
 	Done() <-chan struct{}
+	// The traffic counters of the Link.
+	// Sent and received packets are counted by the caller of Send and Recv.
+	// The Link counts decrypt errors and the packets it drops.
+	Stats() *LinkStats
+}
+
+// LinkStats counts the traffic of a Link.
+// It must be allocated separately, for the 64-bit alignment of the counters.
+type LinkStats struct {
+	// The packets accepted by Send, including the ones dropped by the Link later.
+	SentPackets uint64
+	SentBytes   uint64
+	RecvPackets uint64
+	RecvBytes   uint64
+	// The packets which can't be decrypted.
+	DecryptErrors uint64
+	// The times Send returns an error.
+	SendErrors uint64
+	// The packets dropped by the Link, because its queue is full for example.
+	Dropped uint64
+	// The packets dropped by the rate limit of the Link, they are counted in Dropped too.
+	Limited uint64
+}
+
+func (s *LinkStats) AddSent(n int) {
+	atomic.AddUint64(&s.SentPackets, 1)
+	atomic.AddUint64(&s.SentBytes, uint64(n))
+}
+
+func (s *LinkStats) AddRecv(n int) {
+	atomic.AddUint64(&s.RecvPackets, 1)
+	atomic.AddUint64(&s.RecvBytes, uint64(n))
+}
+
+func (s *LinkStats) AddDecryptError() {
+	atomic.AddUint64(&s.DecryptErrors, 1)
+}
+
+func (s *LinkStats) AddSendError() {
+	atomic.AddUint64(&s.SendErrors, 1)
+}
+
+func (s *LinkStats) AddDropped() {
+	atomic.AddUint64(&s.Dropped, 1)
+}
+
+func (s *LinkStats) AddLimited() {
+	atomic.AddUint64(&s.Dropped, 1)
+	atomic.AddUint64(&s.Limited, 1)
+}
+
+// Load returns a copy of the counters.
+func (s *LinkStats) Load() LinkStats {
+	return LinkStats{
+		SentPackets:   atomic.LoadUint64(&s.SentPackets),
+		SentBytes:     atomic.LoadUint64(&s.SentBytes),
+		RecvPackets:   atomic.LoadUint64(&s.RecvPackets),
+		RecvBytes:     atomic.LoadUint64(&s.RecvBytes),
+		DecryptErrors: atomic.LoadUint64(&s.DecryptErrors),
+		SendErrors:    atomic.LoadUint64(&s.SendErrors),
+		Dropped:       atomic.LoadUint64(&s.Dropped),
+		Limited:       atomic.LoadUint64(&s.Limited),
+	}
+}
+
+// RateLimited is implemented by a Link which has a rate limit.
+type RateLimited interface {
+	// Saturated reports whether the Link is sending at its limit.
+	// The routing prefers other Links to the same peer over a saturated Link.
+	Saturated() bool
+}
+
+// ControlSender is implemented by a Link which drops packets over its rate limit.
+type ControlSender interface {
+	// SendControl sends a routing packet, which isn't dropped by the limit,
+	// otherwise the routes over a busy Link would flap. Its bytes still count.
+	SendControl(packet []byte, dst LinkAddr) error
 }
 
 // cutevpn interacts with the OS through Socket.
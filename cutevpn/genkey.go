@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/clmul/cutevpn/encryption"
+)
+
+// genKey writes a new secret to the first line of a secretfile, which only the owner can access.
+// The secrets of an existing file are kept after the new one, and the new one is staged,
+// so it's accepted but not sent with until every node has it.
+func genKey(name string) error {
+	if name == "" {
+		return errors.New("usage: cutevpn genkey <secretfile>")
+	}
+	key, err := encryption.GenerateKey()
+	if err != nil {
+		return err
+	}
+	old, err := os.ReadFile(name)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	line := key
+	if hasSecrets(old) {
+		line = encryption.StagedPrefix + key
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".secret")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	err = tmp.Chmod(0600)
+	if err == nil {
+		_, err = fmt.Fprintf(tmp, "%v\n%s", line, old)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err1 := tmp.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), name)
+	if err != nil {
+		return err
+	}
+	if line == key {
+		fmt.Printf("wrote key %v to %v\n", encryption.KeyID(key), name)
+		return nil
+	}
+	fmt.Printf("wrote staged key %v to %v\n", encryption.KeyID(key), name)
+	fmt.Printf("remove %q from its line after every node has it, then the old keys after every node sends with it\n", encryption.StagedPrefix)
+	return nil
+}
+
+// hasSecrets reports whether the content of a secretfile has a line which isn't empty or a comment.
+func hasSecrets(content []byte) bool {
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			return true
+		}
+	}
+	return false
+}
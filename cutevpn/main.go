@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 	"golang.org/x/sys/unix"
@@ -43,11 +44,29 @@ func defaultConf(conf *Config) {
 }
 
 func main() {
+	if flag.Arg(0) == "genkey" {
+		// Write a new secret to a file, like
+		// cutevpn genkey /etc/cutevpn/secret
+		err := genKey(flag.Arg(1))
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	conf, err := parseConfigFile(conf)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defaultConf(conf)
+	switch flag.Arg(0) {
+	case "":
+	case "stdio":
+		// Serve the other end of an exec link, like
+		// exec://?cmd=ssh+server+cutevpn+-config+relay.toml+stdio
+		addStdioLink(conf)
+	default:
+		log.Fatalf("unknown command %v", flag.Arg(0))
+	}
 	v, err := vpn.Start(&conf.Config)
 	if err != nil {
 		log.Fatal(err)
@@ -67,8 +86,12 @@ func main() {
 		go socks5Server(conf.SOCKS5Server)
 	}
 
-	<-c
-	log.Println("received SIGINT")
+	select {
+	case <-c:
+		log.Println("received SIGINT")
+	case <-v.Context().Done():
+		log.Println("stopped")
+	}
 
 	if conf.HTTPServer != "" {
 		v.StopHTTP()
@@ -79,6 +102,17 @@ func main() {
 	}
 }
 
+// addStdioLink adds a stdio link to conf unless it has one.
+// Logs are written to stderr, so stdout is only used by the link.
+func addStdioLink(conf *Config) {
+	for _, link := range conf.Links {
+		if strings.HasPrefix(link, "stdio:") {
+			return
+		}
+	}
+	conf.Links = append(conf.Links, "stdio://")
+}
+
 func bash(script string) {
 	cmd := exec.Command("bash", "-x")
 	cmd.Stdin = bytes.NewBufferString(script)
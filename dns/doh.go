@@ -3,7 +3,7 @@ package dns
 import (
 	"context"
 	"encoding/base64"
-	"fmt"
+	"log"
 	"math/rand"
 	"net"
 	"net/http"
@@ -23,7 +23,7 @@ var servers = []string{
 
 func init() {
 	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
-		fmt.Println("dial", network, address)
+		log.Println("dial", network, address)
 		n := rand.Intn(len(servers))
 		server := servers[n]
 		return &dohConn{server: server}, nil
@@ -0,0 +1,242 @@
+package encryption
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/clmul/cutevpn"
+)
+
+// The size of the salt of a sender. Every sender has a subkey derived from its salt,
+// so the salts must not collide even if a secret is shared by many links and restarts.
+// A salt is the time when it's created in nanoseconds and 8 random bytes.
+const saltSize = 16
+
+// The size of the counter which is appended to a packet after the salt.
+const counterSize = 8
+
+// A sender picks a new salt after saltLifetime, so a receiver which forgot the sender
+// because of too many senders knows it again, see senderCache.
+const saltLifetime = 10 * time.Minute
+
+var (
+	errShortPacket = errors.New("packet is too short")
+	errRandomNonce = errors.New("packet with a random nonce is rejected with replay")
+)
+
+// AEAD encrypts packets by an AEAD cipher.
+//
+// Without the replay window, the packets have a random nonce encrypted by the secret like the
+// older versions of cutevpn. With the window, every instance picks a salt, and encrypts by the
+// subkey derived from the secret and the salt by HKDF, with a counter as the nonce. The salt
+// and the counter are appended to every packet, so the receiver rejects the replayed packets
+// by a window of the counters of every salt.
+//
+// The older versions can't decrypt the packets with counters, so the window is 0 by default,
+// and it should be set after every peer is upgraded. Both kinds of packets are received
+// without the window, and the packets with random nonces are rejected with it, because they
+// can be replayed.
+type AEAD struct {
+	key       []byte
+	newCipher func(key []byte) (cipher.AEAD, error)
+	// the cipher of the secret, for random nonces
+	cipher cipher.AEAD
+
+	// lock is held to pick a new salt
+	lock sync.Mutex
+	// the current *saltKey
+	subkey atomic.Value
+	// the counter of the next nonce, accessed atomically
+	counter *uint64
+	// random nonces are sent if it's 0
+	window  int
+	senders *senderCache
+}
+
+// saltKey is a salt and the cipher of its subkey.
+type saltKey struct {
+	salt    []byte
+	cipher  cipher.AEAD
+	created time.Time
+}
+
+func newAEAD(key []byte, newCipher func(key []byte) (cipher.AEAD, error)) (cutevpn.Cipher, error) {
+	aead, err := newCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	a := &AEAD{
+		key:       key,
+		newCipher: newCipher,
+		cipher:    aead,
+		counter:   new(uint64),
+	}
+	k, err := a.newSalt()
+	if err != nil {
+		return nil, err
+	}
+	a.subkey.Store(k)
+	a.SetReplayWindow(0)
+	return a, nil
+}
+
+// newSalt picks a new salt and derives its subkey.
+func (a *AEAD) newSalt() (*saltKey, error) {
+	now := time.Now()
+	salt := make([]byte, saltSize)
+	binary.BigEndian.PutUint64(salt, uint64(now.UnixNano()))
+	_, err := rand.Read(salt[8:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := a.derive(salt)
+	if err != nil {
+		return nil, err
+	}
+	return &saltKey{salt: salt, cipher: aead, created: now}, nil
+}
+
+// currentSalt returns the salt of the sent packets, a new one is picked after saltLifetime.
+func (a *AEAD) currentSalt() *saltKey {
+	k := a.subkey.Load().(*saltKey)
+	if time.Since(k.created) < saltLifetime {
+		return k
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	k = a.subkey.Load().(*saltKey)
+	if time.Since(k.created) < saltLifetime {
+		return k
+	}
+	next, err := a.newSalt()
+	if err != nil {
+		log.Println(err)
+		return k
+	}
+	a.subkey.Store(next)
+	return next
+}
+
+// derive returns the cipher of the subkey of salt.
+func (a *AEAD) derive(salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, len(a.key))
+	_, err := io.ReadFull(hkdf.New(sha256.New, a.key, salt, []byte("cutevpn aead subkey")), subkey)
+	if err != nil {
+		return nil, err
+	}
+	return a.newCipher(subkey)
+}
+
+// SetReplayWindow sets the packets which can be reordered. A window of 0 sends random nonces,
+// and the packets with counters are received by a window of DefaultReplayWindow.
+func (a *AEAD) SetReplayWindow(size int) {
+	a.window = size
+	if size == 0 {
+		size = DefaultReplayWindow
+	}
+	a.senders = newSenderCache(size)
+}
+
+func (a *AEAD) Encrypt(packet []byte) []byte {
+	nonce := make([]byte, a.cipher.NonceSize())
+	if a.window == 0 {
+		_, err := rand.Read(nonce)
+		if err != nil {
+			log.Fatal(err)
+		}
+		packet = a.cipher.Seal(packet[:0], nonce, packet, nil)
+		return append(packet, nonce...)
+	}
+	k := a.currentSalt()
+	counter := nonce[len(nonce)-counterSize:]
+	binary.BigEndian.PutUint64(counter, atomic.AddUint64(a.counter, 1))
+	packet = k.cipher.Seal(packet[:0], nonce, packet, nil)
+	packet = append(packet, k.salt...)
+	return append(packet, counter...)
+}
+
+func (a *AEAD) Decrypt(packet []byte) ([]byte, error) {
+	if len(packet) < saltSize+counterSize+a.cipher.Overhead() {
+		return a.decryptRandom(packet)
+	}
+	trailer := len(packet) - saltSize - counterSize
+	ciphertext, salt := packet[:trailer], packet[trailer:trailer+saltSize]
+	counter := binary.BigEndian.Uint64(packet[trailer+saltSize:])
+	nonce := make([]byte, a.cipher.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-counterSize:], counter)
+
+	s := a.senders.get(salt)
+	if s == nil {
+		// The packet is from a new sender, or it has a random nonce.
+		// A failed Open overwrites the packet, so it's opened to a new buffer.
+		aead, err := a.derive(salt)
+		if err != nil {
+			return nil, err
+		}
+		p, err := aead.Open(nil, nonce, ciphertext, nil)
+		if err != nil {
+			return a.decryptRandom(packet)
+		}
+		s, err = a.senders.add(salt, aead)
+		if err != nil {
+			return nil, err
+		}
+		// Another packet may add the sender at the same time.
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if !s.window.check(counter) {
+			return nil, errReplay
+		}
+		s.window.accept(counter)
+		a.senders.used(s)
+		return append(packet[:0], p...), nil
+	}
+	// The counter is checked and accepted by one packet at a time.
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.window.check(counter) {
+		return nil, errReplay
+	}
+	p, err := s.cipher.Open(ciphertext[:0], nonce, ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.window.accept(counter)
+	a.senders.used(s)
+	return p, nil
+}
+
+// decryptRandom decrypts a packet with a random nonce. Its sender isn't kept,
+// so it's rejected with the replay window.
+func (a *AEAD) decryptRandom(packet []byte) ([]byte, error) {
+	ns := a.cipher.NonceSize()
+	if len(packet) < ns {
+		return nil, errShortPacket
+	}
+	packet, nonce := packet[:len(packet)-ns], packet[len(packet)-ns:]
+	packet, err := a.cipher.Open(packet[:0], nonce, packet, nil)
+	if err != nil {
+		return nil, err
+	}
+	if a.window > 0 {
+		return nil, errRandomNonce
+	}
+	return packet, nil
+}
+
+func (a *AEAD) Overhead() int {
+	if a.window == 0 {
+		return a.cipher.Overhead() + a.cipher.NonceSize()
+	}
+	return a.cipher.Overhead() + saltSize + counterSize
+}
@@ -0,0 +1,40 @@
+package encryption
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/clmul/cutevpn"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// NewChaCha20Poly1305 is faster than AES-GCM on CPUs without AES instructions.
+// The secret is a 32-byte key.
+func NewChaCha20Poly1305(secret string) (cutevpn.Cipher, error) {
+	key, err := decodeKey(secret, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return newAEAD(key, chacha20poly1305.New)
+}
+
+// NewXChaCha20Poly1305 is like NewChaCha20Poly1305, but its 24-byte nonce
+// makes the collisions of random nonces negligible, so it's safer without replay.
+func NewXChaCha20Poly1305(secret string) (cutevpn.Cipher, error) {
+	key, err := decodeKey(secret, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return newAEAD(key, chacha20poly1305.NewX)
+}
+
+func decodeKey(secret string, size int) ([]byte, error) {
+	key, err := hex.DecodeString(secret)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != size {
+		return nil, fmt.Errorf("the secret has %v bytes, it must have %v bytes", len(key), size)
+	}
+	return key, nil
+}
@@ -0,0 +1,45 @@
+package encryption
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/clmul/cutevpn"
+)
+
+// DefaultCipher is used when a link has a secret and no cipher.
+const DefaultCipher = "aesgcm"
+
+// The ciphers which are chosen by the cipher parameter of links.
+var ciphers = map[string]func(secret string) (cutevpn.Cipher, error){
+	"aesgcm":            NewAESGCM,
+	"chacha20poly1305":  NewChaCha20Poly1305,
+	"xchacha20poly1305": NewXChaCha20Poly1305,
+}
+
+// Register adds a cipher, it must be called before the links are created.
+func Register(name string, newCipher func(secret string) (cutevpn.Cipher, error)) {
+	ciphers[name] = newCipher
+}
+
+// New creates the cipher of name with secret.
+func New(name, secret string) (cutevpn.Cipher, error) {
+	if name == "" {
+		name = DefaultCipher
+	}
+	newCipher, ok := ciphers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown cipher %v, it's one of %v", name, Names())
+	}
+	return newCipher(secret)
+}
+
+// Names returns the names of the ciphers.
+func Names() []string {
+	names := make([]string, 0, len(ciphers))
+	for name := range ciphers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
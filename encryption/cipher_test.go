@@ -0,0 +1,52 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestCiphers(t *testing.T) {
+	secrets := map[string]string{
+		"aesgcm":            "255a5b9021450fe59c4712f0e19c9607",
+		"chacha20poly1305":  "c3d1b58f0a9e4e2b7d6f1a0c8e5b3d27255a5b9021450fe59c4712f0e19c9607",
+		"xchacha20poly1305": "9b5ac5f4f1e1d3a2c4c0ac43d5a8a4fb41fa34cd493a5955e185b36abb117a6f",
+	}
+	for _, name := range Names() {
+		c, err := New(name, secrets[name])
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		receiver, _ := New(name, secrets[name])
+		packet := make([]byte, 1400)
+		rand.Read(packet)
+		encrypted := c.Encrypt(append([]byte(nil), packet...))
+		if len(encrypted) != len(packet)+c.Overhead() {
+			t.Fatalf("%v: the overhead is %v, not %v", name, len(encrypted)-len(packet), c.Overhead())
+		}
+		decrypted, err := receiver.Decrypt(append([]byte(nil), encrypted...))
+		if err != nil || !bytes.Equal(decrypted, packet) {
+			t.Fatalf("%v: the packet isn't decrypted: %v", name, err)
+		}
+		encrypted = c.Encrypt(append([]byte(nil), packet...))
+		encrypted[0] ^= 1
+		_, err = receiver.Decrypt(encrypted)
+		if err == nil {
+			t.Fatalf("%v: a changed packet is decrypted", name)
+		}
+	}
+
+	aesgcm, _ := NewAESGCM(secrets["aesgcm"])
+	if _, ok := aesgcm.(*AESGCM); !ok {
+		t.Fatalf("NewAESGCM returns %T", aesgcm)
+	}
+
+	_, err := New("chacha20poly1305", secrets["aesgcm"])
+	if err == nil {
+		t.Fatal("a 16-byte key is accepted by chacha20poly1305")
+	}
+	_, err = New("rot13", secrets["aesgcm"])
+	if err == nil {
+		t.Fatal("an unknown cipher is accepted")
+	}
+}
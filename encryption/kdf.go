@@ -0,0 +1,105 @@
+package encryption
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// KeySize is the size of the keys which are generated or derived, every cipher accepts it.
+const KeySize = 32
+
+// The salt is public, but it must be unique to the mesh, so a passphrase has different keys in different meshes.
+const minSaltSize = 8
+
+// GenerateKey returns a random key in hex.
+func GenerateKey() (string, error) {
+	key := make([]byte, KeySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// The max keys kept by DeriveKey. A secretfile has a few passphrases, so it's only full
+// if the passphrases keep changing, then the cache starts again.
+const maxDerivedKeys = 64
+
+// The keys derived by DeriveKey, by kdfHash of their inputs, so the passphrases aren't kept.
+var derivedKeys = struct {
+	sync.Mutex
+	m map[[sha256.Size]byte]string
+	// the key of kdfHash, a fast hash of a passphrase would be easier to guess than the kdf
+	hashKey []byte
+}{m: make(map[[sha256.Size]byte]string)}
+
+// kdfHash identifies the inputs of DeriveKey. The parameters of every kdf are fixed, so the name is enough.
+func kdfHash(key []byte, kdf, passphrase, salt string) [sha256.Size]byte {
+	h := hmac.New(sha256.New, key)
+	for _, s := range []string{kdf, passphrase, salt} {
+		var n [8]byte
+		binary.BigEndian.PutUint64(n[:], uint64(len(s)))
+		h.Write(n[:])
+		h.Write([]byte(s))
+	}
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// DeriveKey derives a key in hex from a passphrase and a salt by kdf, which is scrypt or argon2.
+// It takes about 100ms, so the keys are cached, and the links of a passphrase and the reloads
+// of a secretfile derive it only once.
+func DeriveKey(kdf, passphrase, salt string) (string, error) {
+	derivedKeys.Lock()
+	defer derivedKeys.Unlock()
+	if derivedKeys.hashKey == nil {
+		derivedKeys.hashKey = make([]byte, sha256.Size)
+		_, err := rand.Read(derivedKeys.hashKey)
+		if err != nil {
+			derivedKeys.hashKey = nil
+			return "", err
+		}
+	}
+	in := kdfHash(derivedKeys.hashKey, kdf, passphrase, salt)
+	if key, ok := derivedKeys.m[in]; ok {
+		return key, nil
+	}
+	key, err := deriveKey(kdf, passphrase, salt)
+	if err != nil {
+		return "", err
+	}
+	if len(derivedKeys.m) >= maxDerivedKeys {
+		derivedKeys.m = make(map[[sha256.Size]byte]string)
+	}
+	derivedKeys.m[in] = key
+	return key, nil
+}
+
+func deriveKey(kdf, passphrase, salt string) (string, error) {
+	if len(salt) < minSaltSize {
+		return "", fmt.Errorf("the salt must have at least %v bytes", minSaltSize)
+	}
+	var key []byte
+	switch kdf {
+	case "scrypt":
+		var err error
+		key, err = scrypt.Key([]byte(passphrase), []byte(salt), 1<<15, 8, 1, KeySize)
+		if err != nil {
+			return "", err
+		}
+	case "argon2":
+		key = argon2.IDKey([]byte(passphrase), []byte(salt), 3, 64*1024, 4, KeySize)
+	default:
+		return "", fmt.Errorf("unknown kdf %v, it's scrypt or argon2", kdf)
+	}
+	return hex.EncodeToString(key), nil
+}
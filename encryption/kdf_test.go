@@ -0,0 +1,59 @@
+package encryption
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDeriveKey(t *testing.T) {
+	for _, kdf := range []string{"scrypt", "argon2"} {
+		key, err := DeriveKey(kdf, "correct horse battery staple", "mesh.example")
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, _ := DeriveKey(kdf, "correct horse battery staple", "mesh.example")
+		other, _ := DeriveKey(kdf, "correct horse battery staple", "other.example")
+		if key != again || key == other {
+			t.Fatalf("%v derives %v, %v and %v with another salt", kdf, key, again, other)
+		}
+		// The second derivation is cached.
+		fresh, _ := deriveKey(kdf, "correct horse battery staple", "mesh.example")
+		derivedKeys.Lock()
+		cached := derivedKeys.m[kdfHash(derivedKeys.hashKey, kdf, "correct horse battery staple", "mesh.example")]
+		derivedKeys.Unlock()
+		if cached != key || fresh != key {
+			t.Fatalf("%v caches %v for %v", kdf, cached, fresh)
+		}
+		_, err = New(DefaultCipher, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := DeriveKey("scrypt", "passphrase", "short")
+	if err == nil {
+		t.Fatal("a short salt is accepted")
+	}
+}
+
+func TestDerivedKeysLimit(t *testing.T) {
+	_, err := DeriveKey("scrypt", "passphrase", "mesh.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	derivedKeys.Lock()
+	for i := len(derivedKeys.m); i < maxDerivedKeys; i++ {
+		derivedKeys.m[kdfHash(derivedKeys.hashKey, "scrypt", fmt.Sprint("passphrase ", i), "mesh.example")] = ""
+	}
+	derivedKeys.Unlock()
+	// The cache starts again when it's full.
+	_, err = DeriveKey("scrypt", "another passphrase", "mesh.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	derivedKeys.Lock()
+	n := len(derivedKeys.m)
+	derivedKeys.Unlock()
+	if n != 1 {
+		t.Fatalf("%v keys are cached", n)
+	}
+}
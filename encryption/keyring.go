@@ -0,0 +1,187 @@
+package encryption
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/clmul/cutevpn"
+)
+
+// The interval of logging the packets which are decrypted by an old key.
+const keyLogInterval = 10 * time.Minute
+
+// StagedPrefix marks a staged secret, like "staged:<secret>". A staged key is accepted,
+// but packets aren't encrypted by it.
+const StagedPrefix = "staged:"
+
+// Keyring encrypts packets by the newest key which isn't staged, and decrypts them by any
+// of the keys. A node can only send with a key after every peer accepts it, so the secret
+// of a mesh is rotated in steps: the new key is staged on every node, then it's unstaged
+// on every node, and the old key is removed. Each step can be done one node at a time.
+// It logs which key decrypts the packets, an old key can be removed when it isn't logged any more.
+type Keyring struct {
+	lock sync.RWMutex
+	name string
+	// the newest key is the first
+	keys []*ringKey
+	// the key of Encrypt
+	sending *ringKey
+	// the replay window of the keys, -1 if it isn't set
+	window int
+}
+
+type ringKey struct {
+	secret string
+	id     string
+	cipher cutevpn.Cipher
+
+	lock    sync.Mutex
+	matched int
+	logged  time.Time
+}
+
+// NewKeyring creates a keyring of the cipher of name with secrets, the newest secret is the first.
+// The staged secrets start with StagedPrefix.
+func NewKeyring(name string, secrets []string) (*Keyring, error) {
+	k := &Keyring{name: name, window: -1}
+	err := k.Set(secrets)
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// KeyID identifies a secret in the logs without showing it.
+func KeyID(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return fmt.Sprintf("%x", sum[:4])
+}
+
+// Set replaces the keys. The keys which are kept keep their replay windows.
+func (k *Keyring) Set(secrets []string) error {
+	if len(secrets) == 0 {
+		return errors.New("no secret")
+	}
+	k.lock.RLock()
+	old := make(map[string]*ringKey)
+	for _, key := range k.keys {
+		old[key.secret] = key
+	}
+	window := k.window
+	k.lock.RUnlock()
+
+	keys := make([]*ringKey, 0, len(secrets))
+	var sending *ringKey
+	for _, secret := range secrets {
+		secret, staged := Unstage(secret)
+		key, ok := old[secret]
+		if !ok {
+			cipher, err := New(k.name, secret)
+			if err != nil {
+				return err
+			}
+			if window >= 0 {
+				setReplayWindow(cipher, window)
+			}
+			key = &ringKey{secret: secret, id: KeyID(secret), cipher: cipher}
+		}
+		keys = append(keys, key)
+		if !staged && sending == nil {
+			sending = key
+		}
+	}
+	if sending == nil {
+		return errors.New("every secret is staged")
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.keys = keys
+	k.sending = sending
+	return nil
+}
+
+// Unstage returns secret without StagedPrefix, and whether it's staged.
+func Unstage(secret string) (string, bool) {
+	if strings.HasPrefix(secret, StagedPrefix) {
+		return secret[len(StagedPrefix):], true
+	}
+	return secret, false
+}
+
+// SetReplayWindow sets the replay window of every key.
+func (k *Keyring) SetReplayWindow(size int) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.window = size
+	for _, key := range k.keys {
+		setReplayWindow(key.cipher, size)
+	}
+}
+
+func setReplayWindow(cipher cutevpn.Cipher, size int) {
+	if c, ok := cipher.(interface{ SetReplayWindow(int) }); ok {
+		c.SetReplayWindow(size)
+	}
+}
+
+func (k *Keyring) Encrypt(packet []byte) []byte {
+	k.lock.RLock()
+	key := k.sending
+	k.lock.RUnlock()
+	return key.cipher.Encrypt(packet)
+}
+
+func (k *Keyring) Decrypt(packet []byte) ([]byte, error) {
+	k.lock.RLock()
+	keys := k.keys
+	k.lock.RUnlock()
+	var err error
+	for i, key := range keys {
+		p := packet
+		// A failed decryption may overwrite the packet.
+		if i < len(keys)-1 {
+			p = append([]byte(nil), packet...)
+		}
+		var e error
+		p, e = key.cipher.Decrypt(p)
+		if e == nil {
+			key.match(i, len(keys))
+			return p, nil
+		}
+		if err == nil || errors.Is(e, errReplay) {
+			err = e
+		}
+	}
+	return nil, err
+}
+
+// match logs the first packet decrypted by the key, and the packets decrypted by an old key
+// at most once every keyLogInterval.
+func (key *ringKey) match(index, count int) {
+	key.lock.Lock()
+	defer key.lock.Unlock()
+	key.matched++
+	now := time.Now()
+	switch {
+	case key.logged.IsZero():
+		log.Printf("key %v (%v of %v) decrypted a packet", key.id, index+1, count)
+	case index > 0 && now.Sub(key.logged) >= keyLogInterval:
+		log.Printf("the old key %v (%v of %v) decrypted %v packets since %v",
+			key.id, index+1, count, key.matched, key.logged.Format(time.Stamp))
+	default:
+		return
+	}
+	key.logged = now
+	key.matched = 0
+}
+
+func (k *Keyring) Overhead() int {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	return k.sending.cipher.Overhead()
+}
@@ -0,0 +1,84 @@
+package encryption
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestKeyring(t *testing.T) {
+	oldKey, newKey := "255a5b9021450fe59c4712f0e19c9607", "8a6e34ac1f6d6bd5d3b8c1f4d0b0b6a9"
+	a, err := NewKeyring("", []string{oldKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := NewKeyring("", []string{newKey, oldKey})
+	a.SetReplayWindow(DefaultReplayWindow)
+	b.SetReplayWindow(DefaultReplayWindow)
+
+	// b accepts both keys, and a still receives from b before it has the new key.
+	packet := []byte("packet")
+	p, err := b.Decrypt(a.Encrypt(append([]byte(nil), packet...)))
+	if err != nil || !bytes.Equal(p, packet) {
+		t.Fatalf("the packet of the old key is %q: %v", p, err)
+	}
+	_, err = a.Decrypt(b.Encrypt(append([]byte(nil), packet...)))
+	if err == nil {
+		t.Fatal("the packet of the new key is decrypted without it")
+	}
+
+	// The old key is replaced, and the replayed packets of the kept key are still rejected.
+	msg := b.Encrypt(append([]byte(nil), packet...))
+	err = a.Set([]string{newKey, oldKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.Decrypt(append([]byte(nil), msg...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.Set([]string{newKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.Decrypt(msg)
+	if err == nil {
+		t.Fatal("a replayed packet is decrypted after the keys change")
+	}
+	_, err = a.Decrypt(encryptBy(t, oldKey))
+	if err == nil {
+		t.Fatal("the packet of a removed key is decrypted")
+	}
+
+	if a.Set(nil) == nil {
+		t.Fatal("a keyring without keys is set")
+	}
+
+	// A staged key is accepted, but the packets are encrypted by the next key.
+	err = a.Set([]string{StagedPrefix + oldKey, newKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	staged, _ := New("", oldKey)
+	setReplayWindow(staged, DefaultReplayWindow)
+	_, err = a.Decrypt(staged.Encrypt(append([]byte(nil), packet...)))
+	if err != nil {
+		t.Fatal("the packet of a staged key isn't decrypted")
+	}
+	newer, _ := New("", newKey)
+	_, err = newer.Decrypt(a.Encrypt(append([]byte(nil), packet...)))
+	if err != nil {
+		t.Fatal("the packet isn't encrypted by the key after the staged one")
+	}
+	if a.Set([]string{StagedPrefix + newKey}) == nil {
+		t.Fatal("a keyring without an unstaged key is set")
+	}
+}
+
+// encryptBy encrypts a packet by a new cipher of secret.
+func encryptBy(t *testing.T, secret string) []byte {
+	c, err := New("", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.Encrypt([]byte("packet"))
+}
@@ -0,0 +1,608 @@
+package encryption
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/clmul/cutevpn"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Noise is a handshake cipher modelled on Noise_IK_25519_ChaChaPoly_SHA256.
+// Every node has a static Curve25519 key, and the initiator knows the public key
+// of the responder. The handshake derives the keys of a session from ephemeral keys,
+// so a leaked static key doesn't decrypt the sessions before it.
+// The initiator starts a new session every noiseRekeyAfter.
+//
+// The handshake messages are the output of Encrypt, in the place of packets:
+//
+//	initiation: [1][sender index 4][ephemeral 32][static 32+16][timestamp 8+16]
+//	response:   [2][sender index 4][receiver index 4][ephemeral 32][packet+16]
+//	data:       [3][receiver index 4][counter 8][packet+16]
+//	empty:      [0]
+//
+// The counters of the data messages are checked by a replay window of DefaultReplayWindow.
+// The packet which is replaced by an initiation is dropped, and the response carries
+// a packet of the responder. Encrypt returns an empty message while a handshake is on the way.
+//
+// A Noise keeps the sessions of every peer address, it's shared by the links which have
+// the same static key, and every link has a view of it from Cipher.
+type Noise struct {
+	lock    sync.Mutex
+	private [32]byte
+	public  [32]byte
+	// the last timestamp of the initiations of every allowed initiator
+	allowed map[[32]byte]uint64
+	// the last timestamp of the initiations of this node
+	timestamp uint64
+
+	peers    map[cutevpn.LinkAddr]*noisePeer
+	sessions map[uint32]*noiseSession
+	// the initiations which wait for responses
+	pending map[uint32]*noiseHandshake
+
+	now func() time.Time
+}
+
+const (
+	noiseProtocol = "Noise_IK_25519_ChaChaPoly_SHA256"
+	noisePrologue = "cutevpn"
+
+	// The initiator starts a new handshake when its session is so old.
+	noiseRekeyAfter = 2 * time.Minute
+	// A session isn't used after it.
+	noiseRejectAfter         = 3 * time.Minute
+	noiseRejectAfterMessages = 1 << 60
+	// An initiation is sent again if it isn't answered in noiseRetry.
+	noiseRetry = 5 * time.Second
+	// The initiator starts a new handshake if nothing is received in its session for so long.
+	noiseSilence = 15 * time.Second
+	// A larger packet isn't sent in a response, so the response fits in the MTU.
+	noiseMaxResponsePacket = 1024
+
+	noiseTypeEmpty      = 0
+	noiseTypeInitiation = 1
+	noiseTypeResponse   = 2
+	noiseTypeData       = 3
+
+	noiseKeySize        = 32
+	noiseTagSize        = chacha20poly1305.Overhead
+	noiseInitiationSize = 1 + 4 + noiseKeySize + noiseKeySize + noiseTagSize + 8 + noiseTagSize
+	noiseResponseHeader = 1 + 4 + 4 + noiseKeySize
+	noiseDataHeader     = 1 + 4 + 8
+)
+
+var (
+	errNoiseMessage = errors.New("invalid noise message")
+	errNoiseSession = errors.New("unknown noise session")
+	errNoiseReplay  = errors.New("replayed noise initiation")
+)
+
+type noisePeer struct {
+	addr cutevpn.LinkAddr
+	// current is the session for sending, and previous is kept for the packets on the way.
+	current  *noiseSession
+	previous *noiseSession
+	// the initiation of the peer which is answered by the next Encrypt
+	respond *noiseHandshake
+	// the last initiation of this node
+	initiation *noiseHandshake
+}
+
+type noiseSession struct {
+	peer          *noisePeer
+	local, remote uint32
+	send, recv    cipher.AEAD
+	initiator     bool
+	created       time.Time
+
+	// protected by the lock of Noise
+	counter  uint64
+	lastRecv time.Time
+	replay   *replayWindow
+}
+
+// NewNoise creates a Noise with the static private key of the node.
+func NewNoise(privateKey []byte) (*Noise, error) {
+	if len(privateKey) != noiseKeySize {
+		return nil, fmt.Errorf("the private key has %v bytes, it must have %v bytes", len(privateKey), noiseKeySize)
+	}
+	n := &Noise{
+		allowed:  make(map[[32]byte]uint64),
+		peers:    make(map[cutevpn.LinkAddr]*noisePeer),
+		sessions: make(map[uint32]*noiseSession),
+		pending:  make(map[uint32]*noiseHandshake),
+		now:      time.Now,
+	}
+	copy(n.private[:], privateKey)
+	public, err := curve25519.X25519(n.private[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	copy(n.public[:], public)
+	return n, nil
+}
+
+// PublicKey returns the static public key of the node.
+func (n *Noise) PublicKey() []byte {
+	return append([]byte(nil), n.public[:]...)
+}
+
+// Allow lets the node with publicKey initiate sessions.
+func (n *Noise) Allow(publicKey []byte) error {
+	if len(publicKey) != noiseKeySize {
+		return fmt.Errorf("the public key has %v bytes, it must have %v bytes", len(publicKey), noiseKeySize)
+	}
+	var key [32]byte
+	copy(key[:], publicKey)
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if _, ok := n.allowed[key]; !ok {
+		n.allowed[key] = 0
+	}
+	return nil
+}
+
+// Cipher returns the cipher of a link. If peerKey isn't nil, it initiates the sessions
+// with the responder of peerKey, which is allowed to initiate too. Otherwise the link
+// only responds to initiations.
+func (n *Noise) Cipher(peerKey []byte) (cutevpn.PeerCipher, error) {
+	c := noiseCipher{Noise: n}
+	if peerKey != nil {
+		err := n.Allow(peerKey)
+		if err != nil {
+			return nil, err
+		}
+		c.responder = new([32]byte)
+		copy(c.responder[:], peerKey)
+	}
+	return c, nil
+}
+
+// noiseCipher is the view of a Noise by a link.
+type noiseCipher struct {
+	*Noise
+	responder *[32]byte
+}
+
+// Encrypt and Decrypt are used by the links with a single peer.
+func (c noiseCipher) Encrypt(packet []byte) []byte {
+	return c.EncryptTo(packet, nil)
+}
+
+func (c noiseCipher) Decrypt(packet []byte) ([]byte, error) {
+	return c.DecryptFrom(packet, nil)
+}
+
+func (c noiseCipher) Overhead() int {
+	return noiseDataHeader + noiseTagSize
+}
+
+func (c noiseCipher) EncryptTo(packet []byte, dst cutevpn.LinkAddr) []byte {
+	n := c.Noise
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	now := n.now()
+	peer := n.peer(dst)
+	if hs := peer.respond; hs != nil {
+		peer.respond = nil
+		if len(packet) > noiseMaxResponsePacket {
+			packet = nil
+		}
+		msg, session, err := hs.writeResponse(packet, now)
+		if err == nil {
+			n.establish(peer, session)
+			return msg
+		}
+	}
+	session := peer.current
+	if session != nil && !session.usable(now) {
+		session = nil
+	}
+	if c.responder != nil && c.needHandshake(peer, session, now) {
+		msg, err := c.initiate(peer, now)
+		if err == nil {
+			return msg
+		}
+	}
+	if session == nil {
+		return []byte{noiseTypeEmpty}
+	}
+	msg := make([]byte, noiseDataHeader, noiseDataHeader+len(packet)+noiseTagSize)
+	msg[0] = noiseTypeData
+	binary.LittleEndian.PutUint32(msg[1:], session.remote)
+	binary.LittleEndian.PutUint64(msg[5:], session.counter)
+	nonce := noiseNonce(session.counter)
+	session.counter++
+	return session.send.Seal(msg, nonce[:], packet, msg[:noiseDataHeader])
+}
+
+// needHandshake reports whether the initiator should start a handshake with peer.
+func (c noiseCipher) needHandshake(peer *noisePeer, session *noiseSession, now time.Time) bool {
+	if hs := peer.initiation; hs != nil && now.Sub(hs.created) < noiseRetry {
+		return false
+	}
+	switch {
+	case session == nil:
+		return true
+	case session.initiator && now.Sub(session.created) > noiseRekeyAfter:
+		return true
+	case now.Sub(session.lastRecv) > noiseSilence:
+		return true
+	}
+	return false
+}
+
+func (c noiseCipher) initiate(peer *noisePeer, now time.Time) ([]byte, error) {
+	n := c.Noise
+	if hs := peer.initiation; hs != nil {
+		delete(n.pending, hs.local)
+	}
+	n.timestamp++
+	if t := uint64(now.UnixNano()); t > n.timestamp {
+		n.timestamp = t
+	}
+	hs, msg, err := n.writeInitiation(*c.responder, n.timestamp, now)
+	if err != nil {
+		return nil, err
+	}
+	hs.peer = peer
+	peer.initiation = hs
+	n.pending[hs.local] = hs
+	return msg, nil
+}
+
+func (c noiseCipher) DecryptFrom(packet []byte, src cutevpn.LinkAddr) ([]byte, error) {
+	if len(packet) == 0 {
+		return nil, errNoiseMessage
+	}
+	n := c.Noise
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	now := n.now()
+	switch packet[0] {
+	case noiseTypeEmpty:
+		return packet[:0], nil
+	case noiseTypeInitiation:
+		hs, err := n.readInitiation(packet)
+		if err != nil {
+			return nil, err
+		}
+		n.peer(src).respond = hs
+		return packet[:0], nil
+	case noiseTypeResponse:
+		if len(packet) < noiseResponseHeader+noiseTagSize {
+			return nil, errNoiseMessage
+		}
+		hs, ok := n.pending[binary.LittleEndian.Uint32(packet[5:])]
+		if !ok {
+			return nil, errNoiseSession
+		}
+		p, session, err := hs.readResponse(packet, now)
+		if err != nil {
+			return nil, err
+		}
+		delete(n.pending, hs.local)
+		if hs.peer.initiation == hs {
+			hs.peer.initiation = nil
+		}
+		n.establish(hs.peer, session)
+		n.roam(hs.peer, src)
+		return p, nil
+	case noiseTypeData:
+		if len(packet) < noiseDataHeader+noiseTagSize {
+			return nil, errNoiseMessage
+		}
+		session, ok := n.sessions[binary.LittleEndian.Uint32(packet[1:])]
+		if !ok || !session.usable(now) {
+			return nil, errNoiseSession
+		}
+		counter := binary.LittleEndian.Uint64(packet[5:])
+		if !session.replay.check(counter) {
+			return nil, errReplay
+		}
+		nonce := noiseNonce(counter)
+		p, err := session.recv.Open(packet[noiseDataHeader:noiseDataHeader], nonce[:], packet[noiseDataHeader:], packet[:noiseDataHeader])
+		if err != nil {
+			return nil, err
+		}
+		session.replay.accept(counter)
+		session.lastRecv = now
+		n.roam(session.peer, src)
+		return p, nil
+	}
+	return nil, errNoiseMessage
+}
+
+// peer returns the peer of addr, it's created if it doesn't exist.
+func (n *Noise) peer(addr cutevpn.LinkAddr) *noisePeer {
+	peer, ok := n.peers[addr]
+	if !ok {
+		peer = &noisePeer{addr: addr}
+		n.peers[addr] = peer
+	}
+	return peer
+}
+
+// roam lets the packets to src use the sessions of peer, when the address of the peer changes.
+func (n *Noise) roam(peer *noisePeer, src cutevpn.LinkAddr) {
+	if n.peers[src] != peer {
+		n.peers[src] = peer
+	}
+}
+
+// establish makes session the current session of peer.
+// The previous one is kept for the packets on the way.
+func (n *Noise) establish(peer *noisePeer, session *noiseSession) {
+	session.peer = peer
+	if peer.previous != nil {
+		delete(n.sessions, peer.previous.local)
+	}
+	peer.previous, peer.current = peer.current, session
+	n.sessions[session.local] = session
+}
+
+func (s *noiseSession) usable(now time.Time) bool {
+	return now.Sub(s.created) < noiseRejectAfter && s.counter < noiseRejectAfterMessages
+}
+
+func noiseNonce(counter uint64) (nonce [chacha20poly1305.NonceSize]byte) {
+	binary.LittleEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
+
+// noiseHandshake is the symmetric state of a handshake.
+type noiseHandshake struct {
+	ck, h  [32]byte
+	k      [32]byte
+	hasKey bool
+	n      uint64
+
+	ephemeral       [32]byte
+	remoteEphemeral [32]byte
+	remoteStatic    [32]byte
+	// the static private key of this node
+	static        [32]byte
+	local, remote uint32
+	initiator     bool
+	created       time.Time
+	peer          *noisePeer
+}
+
+// newHandshake initializes the symmetric state with the public key of the responder.
+func newHandshake(responder [32]byte, static [32]byte, now time.Time) (*noiseHandshake, error) {
+	hs := &noiseHandshake{static: static, created: now}
+	copy(hs.h[:], noiseProtocol)
+	hs.ck = hs.h
+	hs.mixHash([]byte(noisePrologue))
+	hs.mixHash(responder[:])
+	var index [4]byte
+	_, err := rand.Read(index[:])
+	if err != nil {
+		return nil, err
+	}
+	hs.local = binary.LittleEndian.Uint32(index[:])
+	return hs, nil
+}
+
+func (hs *noiseHandshake) mixHash(data []byte) {
+	h := sha256.New()
+	h.Write(hs.h[:])
+	h.Write(data)
+	h.Sum(hs.h[:0])
+}
+
+func (hs *noiseHandshake) mixKey(ikm []byte) {
+	hs.ck, hs.k = noiseHKDF(hs.ck[:], ikm)
+	hs.hasKey = true
+	hs.n = 0
+}
+
+// mixDH mixes the Diffie-Hellman result of a private key and a public key.
+func (hs *noiseHandshake) mixDH(private, public [32]byte) error {
+	shared, err := curve25519.X25519(private[:], public[:])
+	if err != nil {
+		return err
+	}
+	hs.mixKey(shared)
+	return nil
+}
+
+func (hs *noiseHandshake) encryptAndHash(dst, plaintext []byte) []byte {
+	aead, _ := chacha20poly1305.New(hs.k[:])
+	nonce := noiseNonce(hs.n)
+	hs.n++
+	start := len(dst)
+	dst = aead.Seal(dst, nonce[:], plaintext, hs.h[:])
+	hs.mixHash(dst[start:])
+	return dst
+}
+
+func (hs *noiseHandshake) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	aead, _ := chacha20poly1305.New(hs.k[:])
+	nonce := noiseNonce(hs.n)
+	hs.n++
+	plaintext, err := aead.Open(nil, nonce[:], ciphertext, hs.h[:])
+	if err != nil {
+		return nil, err
+	}
+	hs.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// split returns the session after the handshake.
+func (hs *noiseHandshake) split(now time.Time) *noiseSession {
+	k1, k2 := noiseHKDF(hs.ck[:], nil)
+	c1, _ := chacha20poly1305.New(k1[:])
+	c2, _ := chacha20poly1305.New(k2[:])
+	s := &noiseSession{
+		local:     hs.local,
+		remote:    hs.remote,
+		initiator: hs.initiator,
+		created:   now,
+		lastRecv:  now,
+		send:      c1,
+		recv:      c2,
+		replay:    newReplayWindow(DefaultReplayWindow),
+	}
+	if !hs.initiator {
+		s.send, s.recv = c2, c1
+	}
+	return s
+}
+
+func (hs *noiseHandshake) generateEphemeral() ([]byte, error) {
+	_, err := rand.Read(hs.ephemeral[:])
+	if err != nil {
+		return nil, err
+	}
+	return curve25519.X25519(hs.ephemeral[:], curve25519.Basepoint)
+}
+
+// writeInitiation sends -> e, es, s, ss with the timestamp.
+func (n *Noise) writeInitiation(responder [32]byte, timestamp uint64, now time.Time) (*noiseHandshake, []byte, error) {
+	hs, err := newHandshake(responder, n.private, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	hs.initiator = true
+	hs.remoteStatic = responder
+	e, err := hs.generateEphemeral()
+	if err != nil {
+		return nil, nil, err
+	}
+	msg := make([]byte, 5, noiseInitiationSize)
+	msg[0] = noiseTypeInitiation
+	binary.LittleEndian.PutUint32(msg[1:], hs.local)
+	msg = append(msg, e...)
+	hs.mixHash(e)
+	err = hs.mixDH(hs.ephemeral, responder)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg = hs.encryptAndHash(msg, n.public[:])
+	err = hs.mixDH(n.private, responder)
+	if err != nil {
+		return nil, nil, err
+	}
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], timestamp)
+	msg = hs.encryptAndHash(msg, ts[:])
+	return hs, msg, nil
+}
+
+// readInitiation receives an initiation of an allowed initiator.
+// The timestamp must be newer than the last one of the initiator.
+func (n *Noise) readInitiation(msg []byte) (*noiseHandshake, error) {
+	if len(msg) != noiseInitiationSize {
+		return nil, errNoiseMessage
+	}
+	hs, err := newHandshake(n.public, n.private, n.now())
+	if err != nil {
+		return nil, err
+	}
+	hs.remote = binary.LittleEndian.Uint32(msg[1:])
+	msg = msg[5:]
+	copy(hs.remoteEphemeral[:], msg[:noiseKeySize])
+	hs.mixHash(hs.remoteEphemeral[:])
+	msg = msg[noiseKeySize:]
+	err = hs.mixDH(n.private, hs.remoteEphemeral)
+	if err != nil {
+		return nil, err
+	}
+	static, err := hs.decryptAndHash(msg[:noiseKeySize+noiseTagSize])
+	if err != nil {
+		return nil, err
+	}
+	msg = msg[noiseKeySize+noiseTagSize:]
+	copy(hs.remoteStatic[:], static)
+	last, ok := n.allowed[hs.remoteStatic]
+	if !ok {
+		return nil, fmt.Errorf("the noise key %x isn't allowed", static)
+	}
+	err = hs.mixDH(n.private, hs.remoteStatic)
+	if err != nil {
+		return nil, err
+	}
+	ts, err := hs.decryptAndHash(msg)
+	if err != nil {
+		return nil, err
+	}
+	timestamp := binary.BigEndian.Uint64(ts)
+	if timestamp <= last {
+		return nil, errNoiseReplay
+	}
+	n.allowed[hs.remoteStatic] = timestamp
+	return hs, nil
+}
+
+// writeResponse sends <- e, ee, se with packet.
+func (hs *noiseHandshake) writeResponse(packet []byte, now time.Time) ([]byte, *noiseSession, error) {
+	e, err := hs.generateEphemeral()
+	if err != nil {
+		return nil, nil, err
+	}
+	msg := make([]byte, 9, noiseResponseHeader+len(packet)+noiseTagSize)
+	msg[0] = noiseTypeResponse
+	binary.LittleEndian.PutUint32(msg[1:], hs.local)
+	binary.LittleEndian.PutUint32(msg[5:], hs.remote)
+	msg = append(msg, e...)
+	hs.mixHash(e)
+	err = hs.mixDH(hs.ephemeral, hs.remoteEphemeral)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = hs.mixDH(hs.ephemeral, hs.remoteStatic)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg = hs.encryptAndHash(msg, packet)
+	return msg, hs.split(now), nil
+}
+
+// readResponse receives the response of the initiation, and returns the packet in it.
+// hs isn't changed by an invalid response.
+func (pending *noiseHandshake) readResponse(msg []byte, now time.Time) ([]byte, *noiseSession, error) {
+	copied := *pending
+	hs := &copied
+	remote := binary.LittleEndian.Uint32(msg[1:])
+	copy(hs.remoteEphemeral[:], msg[9:noiseResponseHeader])
+	hs.mixHash(hs.remoteEphemeral[:])
+	err := hs.mixDH(hs.ephemeral, hs.remoteEphemeral)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = hs.mixDH(hs.static, hs.remoteEphemeral)
+	if err != nil {
+		return nil, nil, err
+	}
+	packet, err := hs.decryptAndHash(msg[noiseResponseHeader:])
+	if err != nil {
+		return nil, nil, err
+	}
+	hs.remote = remote
+	return packet, hs.split(now), nil
+}
+
+// noiseHKDF derives two keys from the chaining key and the input key material.
+func noiseHKDF(ck, ikm []byte) (k1, k2 [32]byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write(ikm)
+	temp := mac.Sum(nil)
+	mac = hmac.New(sha256.New, temp)
+	mac.Write([]byte{1})
+	mac.Sum(k1[:0])
+	mac = hmac.New(sha256.New, temp)
+	mac.Write(k1[:])
+	mac.Write([]byte{2})
+	mac.Sum(k2[:0])
+	return k1, k2
+}
@@ -0,0 +1,120 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+	"time"
+)
+
+func newTestNoise(t *testing.T, now *time.Time) *Noise {
+	key := make([]byte, 32)
+	rand.Read(key)
+	n, err := NewNoise(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.now = func() time.Time { return *now }
+	return n
+}
+
+func TestNoise(t *testing.T) {
+	now := time.Now()
+	a, b := newTestNoise(t, &now), newTestNoise(t, &now)
+	initiator, err := a.Cipher(b.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder, _ := b.Cipher(nil)
+	b.Allow(a.PublicKey())
+
+	up, down := []byte("packet to the responder"), []byte("packet to the initiator")
+	initiation := initiator.EncryptTo(append([]byte(nil), up...), "b")
+	if initiation[0] != noiseTypeInitiation {
+		t.Fatalf("the first message is type %v", initiation[0])
+	}
+	p, err := responder.DecryptFrom(append([]byte(nil), initiation...), "a")
+	if err != nil || len(p) != 0 {
+		t.Fatalf("the initiation is received as %q: %v", p, err)
+	}
+	if initiator.EncryptTo(append([]byte(nil), up...), "b")[0] != noiseTypeEmpty {
+		t.Fatal("the initiator sends before the response")
+	}
+	response := responder.EncryptTo(append([]byte(nil), down...), "a")
+	if response[0] != noiseTypeResponse {
+		t.Fatalf("the response is type %v", response[0])
+	}
+	p, err = initiator.DecryptFrom(response, "b")
+	if err != nil || !bytes.Equal(p, down) {
+		t.Fatalf("the packet in the response is %q: %v", p, err)
+	}
+
+	exchange := func() {
+		t.Helper()
+		msg := initiator.EncryptTo(append([]byte(nil), up...), "b")
+		p, err := responder.DecryptFrom(msg, "a")
+		if err != nil || !bytes.Equal(p, up) {
+			t.Fatalf("the packet to the responder is %q: %v", p, err)
+		}
+		msg = responder.EncryptTo(append([]byte(nil), down...), "a")
+		p, err = initiator.DecryptFrom(msg, "b")
+		if err != nil || !bytes.Equal(p, down) {
+			t.Fatalf("the packet to the initiator is %q: %v", p, err)
+		}
+	}
+	exchange()
+
+	// A replayed initiation and an unknown initiator are rejected.
+	_, err = responder.DecryptFrom(append([]byte(nil), initiation...), "a")
+	if err == nil {
+		t.Fatal("a replayed initiation is received")
+	}
+	c := newTestNoise(t, &now)
+	stranger, _ := c.Cipher(b.PublicKey())
+	_, err = responder.DecryptFrom(stranger.EncryptTo(nil, "b"), "c")
+	if err == nil {
+		t.Fatal("the initiation of an unknown key is received")
+	}
+	msg := initiator.EncryptTo(append([]byte(nil), up...), "b")
+	_, err = responder.DecryptFrom(append([]byte(nil), msg...), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = responder.DecryptFrom(msg, "a")
+	if err == nil {
+		t.Fatal("a replayed packet is decrypted")
+	}
+	msg = initiator.EncryptTo(append([]byte(nil), up...), "b")
+	msg[len(msg)-1] ^= 1
+	_, err = responder.DecryptFrom(msg, "a")
+	if err == nil {
+		t.Fatal("a changed packet is decrypted")
+	}
+
+	// The initiator starts a new session, and the packets of the old one are still received.
+	late := responder.EncryptTo(append([]byte(nil), down...), "a")
+	now = now.Add(noiseRekeyAfter + time.Second)
+	initiation = initiator.EncryptTo(append([]byte(nil), up...), "b")
+	if initiation[0] != noiseTypeInitiation {
+		t.Fatalf("the initiator doesn't rekey, it sends type %v", initiation[0])
+	}
+	_, err = responder.DecryptFrom(initiation, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = initiator.DecryptFrom(responder.EncryptTo(append([]byte(nil), down...), "a"), "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err = initiator.DecryptFrom(late, "b")
+	if err != nil || !bytes.Equal(p, down) {
+		t.Fatalf("the packet of the old session is %q: %v", p, err)
+	}
+	exchange()
+
+	// A session isn't used after noiseRejectAfter.
+	now = now.Add(noiseRejectAfter)
+	if responder.EncryptTo(append([]byte(nil), down...), "a")[0] != noiseTypeEmpty {
+		t.Fatal("an expired session is used")
+	}
+}
@@ -0,0 +1,153 @@
+package encryption
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+// DefaultReplayWindow is the packets which can be reordered by the network, if replay isn't set.
+const DefaultReplayWindow = 1024
+
+// The max senders whose subkeys and windows are kept, the least recently used one is forgotten.
+const maxReplaySenders = 256
+
+var errReplay = errors.New("replayed packet")
+
+// replayWindow accepts every counter at most once. The counters older than
+// the newest one by the size of the window are rejected.
+type replayWindow struct {
+	bits    []uint64
+	newest  uint64
+	started bool
+}
+
+func newReplayWindow(size int) *replayWindow {
+	return &replayWindow{bits: make([]uint64, (size+63)/64)}
+}
+
+func (w *replayWindow) size() uint64 {
+	return uint64(len(w.bits)) * 64
+}
+
+func (w *replayWindow) bit(counter uint64) (word int, mask uint64) {
+	i := counter % w.size()
+	return int(i / 64), 1 << (i % 64)
+}
+
+// check reports whether counter can be accepted. It's called before the packet is
+// authenticated, and accept is called after it.
+func (w *replayWindow) check(counter uint64) bool {
+	if !w.started || counter > w.newest {
+		return true
+	}
+	if w.newest-counter >= w.size() {
+		return false
+	}
+	word, mask := w.bit(counter)
+	return w.bits[word]&mask == 0
+}
+
+func (w *replayWindow) accept(counter uint64) {
+	switch {
+	case !w.started:
+		w.started = true
+		w.newest = counter
+	case counter > w.newest:
+		if counter-w.newest >= w.size() {
+			for i := range w.bits {
+				w.bits[i] = 0
+			}
+		} else {
+			for c := w.newest + 1; c <= counter; c++ {
+				word, mask := w.bit(c)
+				w.bits[word] &^= mask
+			}
+		}
+		w.newest = counter
+	}
+	word, mask := w.bit(counter)
+	w.bits[word] |= mask
+}
+
+// sender is a peer which encrypts by the subkey of its salt.
+type sender struct {
+	cipher cipher.AEAD
+	// lock is held from checking a counter to accepting it
+	lock     sync.Mutex
+	window   *replayWindow
+	lastUsed uint64
+}
+
+// senderCache keeps the senders which sent an authenticated packet, by their salts.
+//
+// The packets of a forgotten sender could be replayed, so the unknown salts which are created
+// before the newest forgotten one are rejected. A rejected sender is known again when it picks
+// a new salt after saltLifetime.
+type senderCache struct {
+	lock    sync.Mutex
+	window  int
+	senders map[string]*sender
+	seq     uint64
+	// the creation time in the newest forgotten salt
+	forgotten uint64
+}
+
+func newSenderCache(window int) *senderCache {
+	return &senderCache{
+		window:  window,
+		senders: make(map[string]*sender),
+	}
+}
+
+// get returns the sender of salt, or nil if it's unknown.
+func (c *senderCache) get(salt []byte) *sender {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.senders[string(salt)]
+}
+
+// used marks that s sent an authenticated packet.
+func (c *senderCache) used(s *sender) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.seq++
+	s.lastUsed = c.seq
+}
+
+// add adds the sender of salt which sent an authenticated packet. It returns errReplay if the
+// salt is older than a forgotten one.
+func (c *senderCache) add(salt []byte, aead cipher.AEAD) (*sender, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	s, ok := c.senders[string(salt)]
+	if ok {
+		return s, nil
+	}
+	if binary.BigEndian.Uint64(salt) <= c.forgotten {
+		return nil, errReplay
+	}
+	if len(c.senders) >= maxReplaySenders {
+		c.forget()
+	}
+	c.seq++
+	s = &sender{cipher: aead, window: newReplayWindow(c.window), lastUsed: c.seq}
+	c.senders[string(salt)] = s
+	return s, nil
+}
+
+// forget removes the least recently used sender.
+func (c *senderCache) forget() {
+	var oldest string
+	seq := uint64(0)
+	for salt, s := range c.senders {
+		if seq == 0 || s.lastUsed < seq {
+			oldest, seq = salt, s.lastUsed
+		}
+	}
+	if created := binary.BigEndian.Uint64([]byte(oldest)); created > c.forgotten {
+		c.forgotten = created
+	}
+	delete(c.senders, oldest)
+}
@@ -0,0 +1,199 @@
+package encryption
+
+import (
+	"bytes"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReplayWindow(t *testing.T) {
+	w := newReplayWindow(128)
+	counters := make([]uint64, 1000)
+	for i := range counters {
+		counters[i] = uint64(i)
+	}
+	// The counters are reordered in blocks smaller than the window, and some are duplicated.
+	for i := 0; i < len(counters); i += 100 {
+		block := counters[i : i+100]
+		rand.Shuffle(len(block), func(a, b int) {
+			block[a], block[b] = block[b], block[a]
+		})
+	}
+	counters = append(counters, counters[900:]...)
+	accepted := make(map[uint64]bool)
+	for _, c := range counters {
+		if !w.check(c) {
+			continue
+		}
+		if accepted[c] {
+			t.Fatalf("%v is accepted twice", c)
+		}
+		w.accept(c)
+		accepted[c] = true
+	}
+	if len(accepted) != 1000 {
+		t.Fatalf("%v of 1000 reordered counters are accepted", len(accepted))
+	}
+	if w.check(999 - 128) {
+		t.Fatal("a counter older than the window is accepted")
+	}
+	if !w.check(5000) {
+		t.Fatal("a new counter is rejected")
+	}
+}
+
+// newReplayAEAD returns an AES-GCM cipher with the default replay window.
+func newReplayAEAD(t *testing.T, secret string) *AEAD {
+	c, err := NewAESGCM(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.(*AEAD).SetReplayWindow(DefaultReplayWindow)
+	return c.(*AEAD)
+}
+
+func TestAEADReplay(t *testing.T) {
+	secret := "255a5b9021450fe59c4712f0e19c9607"
+	sender, receiver := newReplayAEAD(t, secret), newReplayAEAD(t, secret)
+	var packets [][]byte
+	for i := 0; i < 200; i++ {
+		packets = append(packets, sender.Encrypt([]byte{byte(i)}))
+	}
+	copies := func(i int) []byte {
+		return append([]byte(nil), packets[i]...)
+	}
+	// The packets are reordered in the window, and all of them are received once.
+	order := rand.Perm(len(packets))
+	received := 0
+	for _, i := range order {
+		_, err := receiver.Decrypt(copies(i))
+		if err == nil {
+			received++
+		}
+		_, err = receiver.Decrypt(copies(i))
+		if err == nil {
+			t.Fatalf("packet %v is received twice", i)
+		}
+	}
+	if received != len(packets) {
+		t.Fatalf("%v of %v packets are received", received, len(packets))
+	}
+
+	// Another sender with the same secret has its own window.
+	other := newReplayAEAD(t, secret)
+	_, err := receiver.Decrypt(other.Encrypt([]byte{1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A sender without the window sends random nonces like the older versions.
+	// Its packets can be replayed, so they are rejected with the window.
+	old, _ := NewAESGCM(secret)
+	_, err = receiver.Decrypt(old.Encrypt([]byte{1}))
+	if err != errRandomNonce {
+		t.Fatalf("a packet with a random nonce is decrypted with the window: %v", err)
+	}
+
+	// A receiver without the window receives both kinds of packets,
+	// and it still rejects the replayed packets with counters.
+	legacy, _ := NewAESGCM(secret)
+	for i := 0; i < maxReplaySenders*2; i++ {
+		p, err := legacy.Decrypt(old.Encrypt([]byte{byte(i)}))
+		if err != nil || len(p) != 1 || p[0] != byte(i) {
+			t.Fatalf("the packet with a random nonce is %v: %v", p, err)
+		}
+	}
+	if n := len(legacy.(*AEAD).senders.senders); n != 0 {
+		t.Fatalf("the receiver keeps %v senders for random nonces", n)
+	}
+	_, err = legacy.Decrypt(copies(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = legacy.Decrypt(copies(0))
+	if err == nil {
+		t.Fatal("a replayed packet is received without the window")
+	}
+}
+
+func TestAEADForget(t *testing.T) {
+	secret := "255a5b9021450fe59c4712f0e19c9607"
+	receiver := newReplayAEAD(t, secret)
+	first := newReplayAEAD(t, secret)
+	packet := first.Encrypt([]byte{1})
+	_, err := receiver.Decrypt(append([]byte(nil), packet...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxReplaySenders; i++ {
+		_, err := receiver.Decrypt(newReplayAEAD(t, secret).Encrypt([]byte{1}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if receiver.senders.get(first.currentSalt().salt) != nil {
+		t.Fatal("the least recently used sender isn't forgotten")
+	}
+
+	// The packets of the forgotten sender are rejected, and a new sender is received.
+	_, err = receiver.Decrypt(packet)
+	if err != errReplay {
+		t.Fatalf("a packet of a forgotten sender is decrypted again: %v", err)
+	}
+	_, err = receiver.Decrypt(newReplayAEAD(t, secret).Encrypt([]byte{1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The forgotten sender is received again after it picks a new salt.
+	k := *first.currentSalt()
+	k.created = k.created.Add(-saltLifetime)
+	first.subkey.Store(&k)
+	_, err = receiver.Decrypt(first.Encrypt([]byte{1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(first.currentSalt().salt, k.salt) {
+		t.Fatal("the salt isn't changed after saltLifetime")
+	}
+}
+
+func TestAEADConcurrentReplay(t *testing.T) {
+	secret := "255a5b9021450fe59c4712f0e19c9607"
+	sender, receiver := newReplayAEAD(t, secret), newReplayAEAD(t, secret)
+	// The first packet adds the sender, and the second one is checked by the known sender.
+	for _, packet := range [][]byte{sender.Encrypt([]byte{1}), sender.Encrypt([]byte{2})} {
+		var wg sync.WaitGroup
+		var received int32
+		for i := 0; i < 16; i++ {
+			p := append([]byte(nil), packet...)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := receiver.Decrypt(p)
+				if err == nil {
+					atomic.AddInt32(&received, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		if received != 1 {
+			t.Fatalf("a packet is received %v times", received)
+		}
+	}
+}
+
+func TestAEADSalt(t *testing.T) {
+	secret := "255a5b9021450fe59c4712f0e19c9607"
+	a, b := newReplayAEAD(t, secret), newReplayAEAD(t, secret)
+	// Both start with the same counter, but their subkeys are different.
+	pa, pb := a.Encrypt(make([]byte, 16)), b.Encrypt(make([]byte, 16))
+	if bytes.Equal(pa[len(pa)-counterSize:], pb[len(pb)-counterSize:]) && bytes.Equal(pa[:16], pb[:16]) {
+		t.Fatal("two senders encrypt the same packet with the same counter to the same ciphertext")
+	}
+	if bytes.Equal(a.currentSalt().salt, b.currentSalt().salt) {
+		t.Fatal("two senders have the same salt")
+	}
+}
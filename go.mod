@@ -6,6 +6,8 @@ require (
 	github.com/clmul/socks5 v0.0.0-20180327061726-1a1592f2b65e
 	github.com/clmul/water v0.0.3-0.20241103015558-a0f0a99ed0d9
 	github.com/google/go-cmp v0.5.6
+	golang.org/x/crypto v0.13.0
+	golang.org/x/net v0.15.0
 	golang.org/x/sys v0.12.0
 )
 
@@ -0,0 +1,182 @@
+package link
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/clmul/cutevpn"
+)
+
+// The interval of checking whether the certificate and key files change.
+const credentialsCheckInterval = 10 * time.Second
+
+// credentials are the certificate and the CA bundle of a link.
+// They are loaded again when the files change or the process receives SIGHUP,
+// and new handshakes use the new ones. Established links aren't affected.
+type credentials struct {
+	certFile, keyFile, caFile string
+
+	lock    sync.RWMutex
+	cert    *tls.Certificate
+	ca      *x509.CertPool
+	modTime time.Time
+}
+
+// loadCredentials loads the files, and watches them until vpn stops.
+// Empty file names are skipped.
+func loadCredentials(vpn cutevpn.VPN, certFile, keyFile, caFile string) (*credentials, error) {
+	c := &credentials{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+	}
+	err := c.reload()
+	if err != nil {
+		return nil, err
+	}
+	watchFiles(vpn, c)
+	return c, nil
+}
+
+// reloader is a set of files which are loaded again when they change.
+type reloader interface {
+	fmt.Stringer
+	changed() bool
+	reload() error
+}
+
+// watchFiles reloads r when its files change or the process receives SIGHUP, until vpn stops.
+func watchFiles(vpn cutevpn.VPN, r reloader) {
+	vpn.Go(func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+		tick := time.NewTicker(credentialsCheckInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-vpn.Context().Done():
+				return
+			case <-hup:
+			case <-tick.C:
+				if !r.changed() {
+					continue
+				}
+			}
+			err := r.reload()
+			if err != nil {
+				log.Printf("keep the old %v: %v", r, err)
+				continue
+			}
+			log.Printf("reloaded %v", r)
+		}
+	})
+}
+
+func (c *credentials) String() string {
+	return fmt.Sprint(filterEmpty(c.certFile, c.keyFile, c.caFile))
+}
+
+// files returns the latest modification time of the files.
+func (c *credentials) files() (time.Time, error) {
+	var latest time.Time
+	for _, name := range filterEmpty(c.certFile, c.keyFile, c.caFile) {
+		info, err := os.Stat(name)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (c *credentials) changed() bool {
+	modTime, err := c.files()
+	if err != nil {
+		return false
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return !modTime.Equal(c.modTime)
+}
+
+func (c *credentials) reload() error {
+	modTime, err := c.files()
+	if err != nil {
+		return err
+	}
+	var cert *tls.Certificate
+	if c.certFile != "" || c.keyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+		if err != nil {
+			return err
+		}
+		cert = &certificate
+	}
+	var ca *x509.CertPool
+	if c.caFile != "" {
+		ca, err = loadCertPool(c.caFile)
+		if err != nil {
+			return err
+		}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.cert = cert
+	c.ca = ca
+	c.modTime = modTime
+	return nil
+}
+
+func (c *credentials) load() (*tls.Certificate, *x509.CertPool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.cert, c.ca
+}
+
+// serverConfig returns the config of a listener. Every handshake uses
+// template with the current certificate, and the CA bundle as ClientCAs.
+func (c *credentials) serverConfig(template *tls.Config) *tls.Config {
+	config := template.Clone()
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cert, ca := c.load()
+		config := template.Clone()
+		if cert != nil {
+			config.Certificates = []tls.Certificate{*cert}
+		}
+		config.ClientCAs = ca
+		return config, nil
+	}
+	return config
+}
+
+// clientConfig returns the config of a dialer with the current certificate,
+// and the CA bundle as RootCAs.
+func (c *credentials) clientConfig(template *tls.Config) *tls.Config {
+	cert, ca := c.load()
+	config := template.Clone()
+	if cert != nil {
+		config.Certificates = []tls.Certificate{*cert}
+	}
+	config.RootCAs = ca
+	return config
+}
+
+func filterEmpty(names ...string) []string {
+	var result []string
+	for _, name := range names {
+		if name != "" {
+			result = append(result, name)
+		}
+	}
+	return result
+}
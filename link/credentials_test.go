@@ -0,0 +1,70 @@
+package link
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCredentialsReload(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	writeCertificate(t, dir, "old", now.Add(-time.Minute))
+	c := &credentials{
+		certFile: filepath.Join(dir, "cert.pem"),
+		keyFile:  filepath.Join(dir, "key.pem"),
+		caFile:   filepath.Join(dir, "cert.pem"),
+	}
+	err := c.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := c.serverConfig(&tls.Config{MinVersion: tls.VersionTLS13})
+	commonName := func() string {
+		config, err := server.GetConfigForClient(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert.Subject.CommonName
+	}
+	if name := commonName(); name != "old" {
+		t.Fatalf("the certificate is %v", name)
+	}
+	if c.changed() {
+		t.Fatal("the files aren't changed")
+	}
+
+	writeCertificate(t, dir, "new", now)
+	if !c.changed() {
+		t.Fatal("the change of the files isn't detected")
+	}
+	err = c.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := commonName(); name != "new" {
+		t.Fatalf("the certificate is %v after reloading", name)
+	}
+	if c.clientConfig(&tls.Config{}).RootCAs == nil {
+		t.Fatal("RootCAs isn't set")
+	}
+
+	// A broken file keeps the old certificate.
+	err = os.WriteFile(c.keyFile, []byte("broken"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.reload() == nil {
+		t.Fatal("the broken key is loaded")
+	}
+	if name := commonName(); name != "new" {
+		t.Fatalf("the certificate is %v after a failed reload", name)
+	}
+}
@@ -0,0 +1,706 @@
+package link
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/clmul/cutevpn"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// A DNS link carries packets in DNS queries and responses under a domain,
+// it's the last resort on networks where only DNS gets out.
+// The listener is the authoritative nameserver of the domain, like dns://:53/?domain=t.example.com,
+// and the dialer sends queries to a resolver, like dns://1.1.1.1:53/?domain=t.example.com.
+//
+// Packets are split into fragments, a fragment is [packet ID 2][offset 2][packet size 2][data].
+// A query to the listener is a TXT query of <base32>.<base32>...t.example.com, the labels
+// hold [session ID 4][nonce 2] and a fragment to the listener, or nothing if it's a poll.
+// The random nonce keeps the query from being cached. The response has a TXT record
+// which holds a base64 fragment to the dialer, or an empty string if there is nothing to send.
+// The dialer polls the listener when it has nothing to send, so the link is slow,
+// and the routing protocol uses it when the other links are down.
+
+const (
+	// The max time the dialer waits for a response.
+	dnsTimeout = 2 * time.Second
+	// The dialer gives up a session after the queries fail so many times in a row.
+	dnsMaxFailures = 10
+	// A session is closed if there are no queries in it.
+	dnsSessionTimeout = time.Minute
+	// The poll interval of an idle dialer grows from dnsMinPoll to dnsMaxPoll.
+	dnsMinPoll = 50 * time.Millisecond
+	dnsMaxPoll = time.Second
+	// The max size of a response, it's the EDNS payload size which avoids IP fragmentation.
+	dnsMaxResponse = 1232
+	dnsMaxSessions = 256
+	// The max packets which are reassembled at the same time in a direction of a session.
+	dnsMaxPartial = 16
+	// The default queue is long, because a packet waits for many queries.
+	dnsDefaultQueue = 64
+
+	dnsHeaderSize   = 6
+	dnsFragmentSize = 6
+)
+
+var (
+	errDNSFragment = errors.New("invalid DNS link fragment")
+	// The labels are case insensitive.
+	dnsLabelEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+)
+
+type fragment struct {
+	id     uint16
+	offset int
+	total  int
+	data   []byte
+}
+
+func (f fragment) encode(dst []byte) []byte {
+	var header [dnsFragmentSize]byte
+	binary.BigEndian.PutUint16(header[0:], f.id)
+	binary.BigEndian.PutUint16(header[2:], uint16(f.offset))
+	binary.BigEndian.PutUint16(header[4:], uint16(f.total))
+	dst = append(dst, header[:]...)
+	return append(dst, f.data...)
+}
+
+func decodeFragment(b []byte) (fragment, error) {
+	if len(b) < dnsFragmentSize {
+		return fragment{}, errDNSFragment
+	}
+	f := fragment{
+		id:     binary.BigEndian.Uint16(b[0:]),
+		offset: int(binary.BigEndian.Uint16(b[2:])),
+		total:  int(binary.BigEndian.Uint16(b[4:])),
+		data:   b[dnsFragmentSize:],
+	}
+	if f.offset+len(f.data) > f.total {
+		return fragment{}, errDNSFragment
+	}
+	return f, nil
+}
+
+// fragmenter splits the packets of a queue to fragments.
+type fragmenter struct {
+	packet []byte
+	id     uint16
+	offset int
+	busy   bool
+}
+
+func (f *fragmenter) start(packet []byte) {
+	f.packet = packet
+	f.id++
+	f.offset = 0
+	f.busy = true
+}
+
+// next returns the next fragment which has at most max bytes of data.
+// It takes a packet from out if the last one is sent, and returns false if out is empty.
+func (f *fragmenter) next(out chan []byte, max int) (fragment, bool) {
+	if !f.busy {
+		select {
+		case p := <-out:
+			f.start(p)
+		default:
+			return fragment{}, false
+		}
+	}
+	n := len(f.packet) - f.offset
+	if n > max {
+		n = max
+	}
+	frag := fragment{
+		id:     f.id,
+		offset: f.offset,
+		total:  len(f.packet),
+		data:   f.packet[f.offset : f.offset+n],
+	}
+	f.offset += n
+	f.busy = f.offset < len(f.packet)
+	return frag, true
+}
+
+// reassembler joins the fragments to packets. Fragments can be lost,
+// duplicated or reordered, the oldest partial packet is dropped when
+// there are too many of them.
+type reassembler struct {
+	partial map[uint16]*partialPacket
+	seq     int
+}
+
+type partialPacket struct {
+	data     []byte
+	offsets  map[int]bool
+	received int
+	seq      int
+}
+
+// add returns the packet if the fragment completes it.
+func (r *reassembler) add(f fragment) []byte {
+	if r.partial == nil {
+		r.partial = make(map[uint16]*partialPacket)
+	}
+	p, ok := r.partial[f.id]
+	if ok && len(p.data) != f.total {
+		// The ID is reused by a new packet.
+		delete(r.partial, f.id)
+		ok = false
+	}
+	if !ok {
+		if len(r.partial) >= dnsMaxPartial {
+			r.dropOldest()
+		}
+		r.seq++
+		p = &partialPacket{
+			data:    make([]byte, f.total),
+			offsets: make(map[int]bool),
+			seq:     r.seq,
+		}
+		r.partial[f.id] = p
+	}
+	if !p.offsets[f.offset] {
+		p.offsets[f.offset] = true
+		p.received += copy(p.data[f.offset:], f.data)
+	}
+	if p.received < len(p.data) {
+		return nil
+	}
+	delete(r.partial, f.id)
+	return p.data
+}
+
+func (r *reassembler) dropOldest() {
+	oldest, seq := uint16(0), -1
+	for id, p := range r.partial {
+		if seq < 0 || p.seq < seq {
+			oldest, seq = id, p.seq
+		}
+	}
+	delete(r.partial, oldest)
+}
+
+// dnsPayload returns the max bytes in a query name under domain.
+func dnsPayload(domain string) int {
+	// A name has at most 253 characters, every label has at most 63.
+	avail := 253 - len(domain)
+	chars := avail - (avail+63)/64
+	return chars * 5 / 8
+}
+
+// encodeDNSName encodes payload in the labels of a name under domain.
+func encodeDNSName(payload []byte, domain string) string {
+	s := dnsLabelEncoding.EncodeToString(payload)
+	var b strings.Builder
+	for len(s) > 63 {
+		b.WriteString(s[:63])
+		b.WriteByte('.')
+		s = s[63:]
+	}
+	if s != "" {
+		b.WriteString(s)
+		b.WriteByte('.')
+	}
+	b.WriteString(domain)
+	b.WriteByte('.')
+	return b.String()
+}
+
+// decodeDNSName returns the payload of a name under domain.
+// domain and name must be lower case, and name must end with a dot.
+func decodeDNSName(name, domain string) ([]byte, bool) {
+	labels := strings.TrimSuffix(name, domain+".")
+	if labels == name || labels != "" && !strings.HasSuffix(labels, ".") {
+		return nil, false
+	}
+	payload, err := dnsLabelEncoding.DecodeString(strings.ReplaceAll(labels, ".", ""))
+	if err != nil {
+		return nil, true
+	}
+	return payload, true
+}
+
+func parseDNSConfig(linkURL *url.URL, cipher cutevpn.Cipher) (streamConfig, string, error) {
+	config, err := parseStreamConfig(linkURL, cipher)
+	if err != nil {
+		return config, "", err
+	}
+	if linkURL.Query().Get("queue") == "" {
+		config.queue = dnsDefaultQueue
+	}
+	domain := strings.ToLower(strings.Trim(linkURL.Query().Get("domain"), "."))
+	if domain == "" {
+		return config, "", fmt.Errorf("dns needs domain")
+	}
+	// The packet which opens a session is sent in one query.
+	if dnsPayload(domain) < dnsHeaderSize+dnsFragmentSize+signalSize+cipher.Overhead() {
+		return config, "", fmt.Errorf("the domain %v is too long", domain)
+	}
+	return config, domain, nil
+}
+
+func newDNS(vpn cutevpn.VPN, linkURL *url.URL, cipher cutevpn.Cipher) error {
+	config, domain, err := parseDNSConfig(linkURL, cipher)
+	if err != nil {
+		return err
+	}
+	if linkURL.Hostname() == "" {
+		conn, err := net.ListenPacket("udp", linkURL.Host)
+		if err != nil {
+			return err
+		}
+		vpn.OnCancel(vpn.Context(), func() {
+			conn.Close()
+		})
+		vpn.Loop(newDNSServer(vpn, conn, domain, config).serve)
+		return nil
+	}
+	resolver := linkURL.Host
+	if linkURL.Port() == "" {
+		resolver = net.JoinHostPort(linkURL.Hostname(), "53")
+	}
+	vpn.Loop(func(ctx context.Context) error {
+		return connect(ctx, vpn, func(ctx context.Context) (cutevpn.Link, error) {
+			return dialDNS(ctx, vpn, resolver, domain, config)
+		})
+	})
+	return nil
+}
+
+// dnsServer answers the queries of the sessions of DNS links.
+// The queries are served one by one, so it doesn't need a lock.
+type dnsServer struct {
+	vpn    cutevpn.VPN
+	conn   net.PacketConn
+	domain string
+	config streamConfig
+
+	sessions   map[uint32]*dnsSession
+	lastExpire time.Time
+}
+
+type dnsSession struct {
+	link     *pollLink
+	up       reassembler
+	down     fragmenter
+	lastSeen time.Time
+}
+
+func newDNSServer(vpn cutevpn.VPN, conn net.PacketConn, domain string, config streamConfig) *dnsServer {
+	return &dnsServer{
+		vpn:        vpn,
+		conn:       conn,
+		domain:     domain,
+		config:     config,
+		sessions:   make(map[uint32]*dnsSession),
+		lastExpire: time.Now(),
+	}
+}
+
+// serve answers a query. The read times out, so the idle sessions are expired
+// when there are no queries.
+func (s *dnsServer) serve(ctx context.Context) error {
+	buffer := make([]byte, 4096)
+	s.conn.SetReadDeadline(time.Now().Add(dnsSessionTimeout / 6))
+	n, addr, err := s.conn.ReadFrom(buffer)
+	if time.Since(s.lastExpire) > dnsSessionTimeout/6 {
+		s.expire()
+	}
+	if err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil
+		}
+		return err
+	}
+	response := s.answer(buffer[:n], addr)
+	if response == nil {
+		return nil
+	}
+	_, err = s.conn.WriteTo(response, addr)
+	if err != nil {
+		log.Println(err)
+	}
+	return nil
+}
+
+func (s *dnsServer) expire() {
+	s.lastExpire = time.Now()
+	for id, session := range s.sessions {
+		if session.link.ctx.Err() != nil {
+			delete(s.sessions, id)
+			continue
+		}
+		if time.Since(session.lastSeen) < dnsSessionTimeout {
+			continue
+		}
+		log.Printf("%v expired", session.link.ToString(nil))
+		session.link.Cancel()
+		delete(s.sessions, id)
+	}
+}
+
+// answer returns the response of query, or nil if it isn't a valid query.
+func (s *dnsServer) answer(query []byte, addr net.Addr) []byte {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil || header.Response {
+		return nil
+	}
+	question, err := p.Question()
+	if err != nil {
+		return nil
+	}
+	// The response fits the EDNS payload size of the query, or 512 bytes without EDNS.
+	limit, edns := 512, false
+	if p.SkipAllQuestions() == nil && p.SkipAllAnswers() == nil && p.SkipAllAuthorities() == nil {
+		for {
+			h, err := p.AdditionalHeader()
+			if err != nil {
+				break
+			}
+			if h.Type == dnsmessage.TypeOPT {
+				edns = true
+				if size := int(h.Class); size > limit {
+					limit = size
+				}
+			}
+			if p.SkipAdditional() != nil {
+				break
+			}
+		}
+	}
+	if limit > dnsMaxResponse {
+		limit = dnsMaxResponse
+	}
+
+	name := strings.ToLower(question.Name.String())
+	rcode := dnsmessage.RCodeSuccess
+	var txt []string
+	payload, ok := decodeDNSName(name, s.domain)
+	switch {
+	case !ok:
+		// It isn't in the domain of the server.
+		rcode = dnsmessage.RCodeRefused
+	case question.Type == dnsmessage.TypeTXT && len(payload) >= dnsHeaderSize:
+		// The header, the question, a compressed TXT record and an OPT record.
+		avail := limit - 12 - (len(name) + 1 + 4) - 12 - 11
+		// Every string of a TXT record has at most 255 bytes after a length byte.
+		chars := avail - (avail+255)/256
+		txt = s.session(payload, addr, chars*3/4-dnsFragmentSize)
+	}
+	// Other names in the domain have no records, they aren't NXDOMAIN,
+	// because resolvers may take it as the domain has no subdomains.
+
+	b := dnsmessage.NewBuilder(make([]byte, 0, limit), dnsmessage.Header{
+		ID:               header.ID,
+		Response:         true,
+		Authoritative:    rcode == dnsmessage.RCodeSuccess,
+		RecursionDesired: header.RecursionDesired,
+		RCode:            rcode,
+	})
+	b.EnableCompression()
+	err = b.StartQuestions()
+	if err == nil {
+		err = b.Question(question)
+	}
+	if err == nil && txt != nil {
+		err = b.StartAnswers()
+		if err == nil {
+			err = b.TXTResource(dnsmessage.ResourceHeader{
+				Name:  question.Name,
+				Class: dnsmessage.ClassINET,
+			}, dnsmessage.TXTResource{TXT: txt})
+		}
+	}
+	if err == nil && edns {
+		err = b.StartAdditionals()
+		if err == nil {
+			var h dnsmessage.ResourceHeader
+			err = h.SetEDNS0(dnsMaxResponse, dnsmessage.RCodeSuccess, false)
+			if err == nil {
+				err = b.OPTResource(h, dnsmessage.OPTResource{})
+			}
+		}
+	}
+	response, err := b.Finish()
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	return response
+}
+
+// session receives the payload of a query, and returns the TXT strings which
+// hold a fragment of at most max bytes. It returns nil for the queries of a session
+// which isn't opened.
+func (s *dnsServer) session(payload []byte, addr net.Addr, max int) []string {
+	id := binary.BigEndian.Uint32(payload)
+	session, ok := s.sessions[id]
+	if !ok {
+		session = s.open(id, payload[dnsHeaderSize:], addr)
+		if session == nil {
+			return nil
+		}
+	} else if len(payload) > dnsHeaderSize {
+		frag, err := decodeFragment(payload[dnsHeaderSize:])
+		if err != nil {
+			return nil
+		}
+		if packet := session.up.add(frag); packet != nil {
+			// The server can't wait for Recv.
+			select {
+			case session.link.in <- packet:
+			default:
+				session.link.stats.AddDropped()
+			}
+		}
+	}
+	session.lastSeen = time.Now()
+	var data []byte
+	if max > 0 {
+		if frag, ok := session.down.next(session.link.out, max); ok {
+			data = frag.encode(nil)
+		}
+	}
+	return splitTXT(base64.RawStdEncoding.EncodeToString(data))
+}
+
+// open opens a session by its first query, which holds a whole packet that is decrypted.
+// Nothing is kept for the queries which aren't authenticated, so they can't fill the sessions.
+func (s *dnsServer) open(id uint32, payload []byte, addr net.Addr) *dnsSession {
+	if len(s.sessions) >= dnsMaxSessions {
+		return nil
+	}
+	frag, err := decodeFragment(payload)
+	if err != nil || frag.offset != 0 || len(frag.data) != frag.total {
+		return nil
+	}
+	_, err = s.config.cipher.Decrypt(append([]byte(nil), frag.data...))
+	if err != nil {
+		return nil
+	}
+	session := &dnsSession{
+		link: newPollLink(s.vpn.Context(), s.config, "dns", fmt.Sprintf("session:%08x", id), addr.String(), nil),
+	}
+	s.sessions[id] = session
+	s.vpn.AddLink(session.link)
+	return session
+}
+
+func splitTXT(s string) []string {
+	txt := []string{}
+	for len(s) > 255 {
+		txt = append(txt, s[:255])
+		s = s[255:]
+	}
+	return append(txt, s)
+}
+
+// dnsClient is the dialer end of a DNS session.
+type dnsClient struct {
+	*pollLink
+	conn    net.Conn
+	domain  string
+	session uint32
+	// The max bytes of data in the fragment of a query.
+	capacity int
+	up       fragmenter
+	down     reassembler
+}
+
+// dialDNS opens a session through resolver, and starts the query loop.
+func dialDNS(ctx context.Context, vpn cutevpn.VPN, resolver, domain string, config streamConfig) (cutevpn.Link, error) {
+	var id [4]byte
+	_, err := rand.Read(id[:])
+	if err != nil {
+		return nil, err
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", resolver)
+	if err != nil {
+		return nil, err
+	}
+	c := &dnsClient{
+		conn:     conn,
+		domain:   domain,
+		session:  binary.BigEndian.Uint32(id[:]),
+		capacity: dnsPayload(domain) - dnsHeaderSize - dnsFragmentSize,
+	}
+	c.pollLink = newPollLink(ctx, config, "dns", fmt.Sprintf("session:%08x", c.session), resolver, resolver)
+	// The opening packet fits a query.
+	c.up.start(openingPacket(c.cipher))
+	frag, _ := c.up.next(c.out, c.capacity)
+	_, err = c.exchange(&frag)
+	if err != nil {
+		c.cancel()
+		conn.Close()
+		return nil, err
+	}
+	vpn.OnCancel(c.ctx, func() {
+		conn.Close()
+	})
+	vpn.Go(c.loop)
+	return c, nil
+}
+
+// loop sends a query at a time. It polls more slowly when nothing is sent or received.
+func (c *dnsClient) loop() {
+	delay := time.Duration(0)
+	failures := 0
+	for c.ctx.Err() == nil {
+		frag, ok := c.up.next(c.out, c.capacity)
+		if !ok && delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case p := <-c.out:
+				c.up.start(p)
+				frag, ok = c.up.next(c.out, c.capacity)
+			case <-timer.C:
+			case <-c.ctx.Done():
+			}
+			timer.Stop()
+			if c.ctx.Err() != nil {
+				return
+			}
+		}
+		var sent *fragment
+		if ok {
+			sent = &frag
+		}
+		received, err := c.exchange(sent)
+		if err != nil {
+			if c.ctx.Err() != nil {
+				return
+			}
+			log.Printf("%v: %v", c.ToString(nil), err)
+			failures++
+			if failures >= dnsMaxFailures {
+				c.cancel()
+				return
+			}
+			continue
+		}
+		failures = 0
+		switch {
+		case ok || received:
+			delay = 0
+		case delay == 0:
+			delay = dnsMinPoll
+		case delay < dnsMaxPoll:
+			delay *= 2
+			if delay > dnsMaxPoll {
+				delay = dnsMaxPoll
+			}
+		}
+	}
+}
+
+// exchange sends a query with frag, or a poll if frag is nil.
+// It returns whether the response has a fragment.
+func (c *dnsClient) exchange(frag *fragment) (bool, error) {
+	var random [4]byte
+	_, err := rand.Read(random[:])
+	if err != nil {
+		return false, err
+	}
+	payload := make([]byte, dnsHeaderSize)
+	binary.BigEndian.PutUint32(payload, c.session)
+	copy(payload[4:], random[:2])
+	if frag != nil {
+		payload = frag.encode(payload)
+	}
+	name, err := dnsmessage.NewName(encodeDNSName(payload, c.domain))
+	if err != nil {
+		return false, err
+	}
+	id := binary.BigEndian.Uint16(random[2:])
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET})
+	b.StartAdditionals()
+	var opt dnsmessage.ResourceHeader
+	opt.SetEDNS0(dnsMaxResponse, dnsmessage.RCodeSuccess, false)
+	b.OPTResource(opt, dnsmessage.OPTResource{})
+	query, err := b.Finish()
+	if err != nil {
+		return false, err
+	}
+
+	c.conn.SetDeadline(time.Now().Add(dnsTimeout))
+	_, err = c.conn.Write(query)
+	if err != nil {
+		return false, err
+	}
+	buffer := make([]byte, 4096)
+	for {
+		n, err := c.conn.Read(buffer)
+		if err != nil {
+			return false, err
+		}
+		var p dnsmessage.Parser
+		header, err := p.Start(buffer[:n])
+		if err != nil || header.ID != id || !header.Response {
+			continue
+		}
+		if header.RCode != dnsmessage.RCodeSuccess {
+			return false, fmt.Errorf("the response is %v", header.RCode)
+		}
+		err = p.SkipAllQuestions()
+		if err != nil {
+			return false, err
+		}
+		return c.response(&p)
+	}
+}
+
+// response receives the fragment in the TXT record of a response.
+func (c *dnsClient) response(p *dnsmessage.Parser) (bool, error) {
+	for {
+		h, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			// The server doesn't know the session, it may be restarted.
+			return false, errors.New("the session is lost")
+		}
+		if err != nil {
+			return false, err
+		}
+		if h.Type != dnsmessage.TypeTXT {
+			err = p.SkipAnswer()
+			if err != nil {
+				return false, err
+			}
+			continue
+		}
+		txt, err := p.TXTResource()
+		if err != nil {
+			return false, err
+		}
+		data, err := base64.RawStdEncoding.DecodeString(strings.Join(txt.TXT, ""))
+		if err != nil {
+			return false, err
+		}
+		if len(data) == 0 {
+			return false, nil
+		}
+		frag, err := decodeFragment(data)
+		if err != nil {
+			return false, err
+		}
+		if packet := c.down.add(frag); packet != nil {
+			c.receive(c.ctx, [][]byte{packet})
+		}
+		return true, nil
+	}
+}
@@ -0,0 +1,175 @@
+package link
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/clmul/cutevpn"
+	"github.com/clmul/cutevpn/encryption"
+)
+
+func TestDNSFragments(t *testing.T) {
+	out := make(chan []byte, 4)
+	packets := [][]byte{randomPacket(1400), randomPacket(1), randomPacket(300)}
+	for _, p := range packets {
+		out <- p
+	}
+	var f fragmenter
+	var frags []fragment
+	for {
+		frag, ok := f.next(out, 100)
+		if !ok {
+			break
+		}
+		frags = append(frags, frag)
+	}
+	// The fragments are duplicated and reordered.
+	frags = append(frags, frags[:5]...)
+	rand.Shuffle(len(frags), func(i, j int) {
+		frags[i], frags[j] = frags[j], frags[i]
+	})
+	var r reassembler
+	received := make(map[int][]byte)
+	for _, frag := range frags {
+		decoded, err := decodeFragment(frag.encode(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p := r.add(decoded); p != nil {
+			received[len(p)] = p
+		}
+	}
+	for _, p := range packets {
+		if !bytes.Equal(received[len(p)], p) {
+			t.Fatalf("the packet of %v bytes is changed", len(p))
+		}
+	}
+
+	domain := "t.example.com"
+	payload := randomPacket(dnsPayload(domain))
+	name := encodeDNSName(payload, domain)
+	if len(name) > 254 {
+		t.Fatalf("the name has %v characters", len(name))
+	}
+	decoded, ok := decodeDNSName(name, domain)
+	if !ok || !bytes.Equal(decoded, payload) {
+		t.Fatal("the name isn't decoded")
+	}
+	if _, ok := decodeDNSName("abc.example.com.", domain); ok {
+		t.Fatal("a name out of the domain is decoded")
+	}
+}
+
+func TestDNSSession(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cipher, err := encryption.NewAESGCM("255a5b9021450fe59c4712f0e19c9607")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := streamConfig{cipher: cipher, queue: dnsDefaultQueue}
+	domain := "t.example.com"
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	serverVPN := newTestVPN(ctx)
+	serverVPN.Loop(newDNSServer(serverVPN, conn, domain, config).serve)
+
+	// The dialer sends the queries to the server directly, without a resolver.
+	clientVPN := newTestVPN(ctx)
+	client, err := dialDNS(ctx, clientVPN, conn.LocalAddr().String(), domain, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var server cutevpn.Link
+	select {
+	case server = <-serverVPN.links:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session isn't opened")
+	}
+
+	for i := 0; i < 5; i++ {
+		up, down := randomPacket(1400), randomPacket(1400)
+		client.Send(append([]byte(nil), up...), nil)
+		if !bytes.Equal(recvPacket(t, server), up) {
+			t.Fatal("the packet to the server is changed")
+		}
+		// It's sent in the responses of the polls.
+		server.Send(append([]byte(nil), down...), nil)
+		if !bytes.Equal(recvPacket(t, client), down) {
+			t.Fatal("the packet to the client is changed")
+		}
+	}
+
+	// The client closes the session when the server is restarted.
+	conn.Close()
+	conn, err = net.ListenPacket("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	serverVPN.Loop(newDNSServer(serverVPN, conn, domain, config).serve)
+	select {
+	case <-client.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the client keeps a lost session")
+	}
+}
+
+func TestDNSOpen(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cipher, err := encryption.NewAESGCM("255a5b9021450fe59c4712f0e19c9607")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := streamConfig{cipher: cipher, queue: dnsDefaultQueue}
+	vpn := newTestVPN(ctx)
+	s := newDNSServer(vpn, nil, "t.example.com", config)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+	query := func(id uint32, packet []byte, offset, total int) []string {
+		payload := make([]byte, dnsHeaderSize)
+		binary.BigEndian.PutUint32(payload, id)
+		if packet != nil {
+			payload = fragment{offset: offset, total: total, data: packet}.encode(payload)
+		}
+		return s.session(payload, addr, 100)
+	}
+
+	// Polls, fragments and garbage of unknown sessions are ignored.
+	opener := openingPacket(cipher)
+	for id := uint32(0); id < dnsMaxSessions*2; id++ {
+		if query(id, nil, 0, 0) != nil || query(id, randomPacket(len(opener)), 0, len(opener)) != nil ||
+			query(id, opener[:10], 0, len(opener)) != nil {
+			t.Fatalf("session %v is answered before it's opened", id)
+		}
+	}
+	if len(s.sessions) != 0 {
+		t.Fatalf("%v sessions are kept", len(s.sessions))
+	}
+
+	if query(1, opener, 0, len(opener)) == nil {
+		t.Fatal("the session isn't opened")
+	}
+	<-vpn.links
+	if query(1, nil, 0, 0) == nil {
+		t.Fatal("a poll of the session isn't answered")
+	}
+
+	// The domain leaves 38 bytes in a query, and the opening packet has 49.
+	long := strings.Repeat(strings.Repeat("a", 59)+".", 3) + "example.com"
+	_, _, err = parseDNSConfig(&url.URL{Scheme: "dns", Host: ":53", RawQuery: "domain=" + long}, cipher)
+	if err == nil {
+		t.Fatal("a domain which can't hold the opening packet is accepted")
+	}
+}
@@ -0,0 +1,172 @@
+package link
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// The delay between the first dial and the first retry.
+	minBackoff = time.Second
+	// The max delay between dials.
+	maxBackoff = 2 * time.Minute
+	// The delay before starting to dial the next address while the previous one is pending.
+	happyEyeballsDelay = 250 * time.Millisecond
+)
+
+// backoff is the delay between failed dials, which doubles after every
+// failure up to maxBackoff. The delay is randomized, so the dialers of many
+// nodes don't reconnect to a restarted server at the same time.
+type backoff struct {
+	failures int
+}
+
+func (b *backoff) next() time.Duration {
+	d := maxBackoff
+	if b.failures < 16 {
+		d = minBackoff << b.failures
+		if d > maxBackoff {
+			d = maxBackoff
+		}
+	}
+	b.failures++
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// endpoints are the addresses of the server of a dialer. The host of the link
+// URL is the first one, and more can be added by endpoints=host1:port1,host2:port2.
+type endpoints struct {
+	addrs []string
+	dial  dialer
+	// The hostnames are resolved to all the A/AAAA records by the dialer,
+	// unless the dialer uses a proxy, which resolves them.
+	resolve bool
+}
+
+func newEndpoints(linkURL *url.URL, dial dialer) (*endpoints, error) {
+	e := &endpoints{
+		addrs:   []string{linkURL.Host},
+		dial:    dial,
+		resolve: linkURL.Query().Get("proxy") == "",
+	}
+	if s := linkURL.Query().Get("endpoints"); s != "" {
+		for _, addr := range strings.Split(s, ",") {
+			_, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			e.addrs = append(e.addrs, addr)
+		}
+	}
+	return e, nil
+}
+
+// candidates returns the addresses to dial, the A and AAAA records are interleaved.
+func (e *endpoints) candidates(ctx context.Context) []string {
+	if !e.resolve {
+		return e.addrs
+	}
+	var result []string
+	for _, addr := range e.addrs {
+		host, port, _ := net.SplitHostPort(addr)
+		if net.ParseIP(host) != nil {
+			result = append(result, addr)
+			continue
+		}
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil || len(ips) == 0 {
+			// Let the dialer report the error.
+			result = append(result, addr)
+			continue
+		}
+		var v4, v6 []string
+		for _, ip := range ips {
+			if ip.IP.To4() != nil {
+				v4 = append(v4, net.JoinHostPort(ip.String(), port))
+			} else {
+				v6 = append(v6, net.JoinHostPort(ip.String(), port))
+			}
+		}
+		for len(v4) > 0 || len(v6) > 0 {
+			if len(v6) > 0 {
+				result = append(result, v6[0])
+				v6 = v6[1:]
+			}
+			if len(v4) > 0 {
+				result = append(result, v4[0])
+				v4 = v4[1:]
+			}
+		}
+	}
+	return result
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// Dial races the candidates like Happy Eyeballs. A dial is started every
+// happyEyeballsDelay or when the previous one fails, and the first
+// connection wins.
+func (e *endpoints) Dial(ctx context.Context) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	candidates := e.candidates(ctx)
+	results := make(chan dialResult, len(candidates))
+	pending := 0
+	var errs []string
+	next := time.NewTimer(0)
+	defer next.Stop()
+	for len(candidates) > 0 || pending > 0 {
+		timer := next.C
+		if len(candidates) == 0 {
+			timer = nil
+		}
+		select {
+		case <-ctx.Done():
+			go closeLosers(results, pending)
+			return nil, ctx.Err()
+		case <-timer:
+			addr := candidates[0]
+			candidates = candidates[1:]
+			pending++
+			go func() {
+				conn, err := e.dial(ctx, addr)
+				results <- dialResult{conn, err}
+			}()
+			next.Reset(happyEyeballsDelay)
+		case r := <-results:
+			pending--
+			if r.err != nil {
+				errs = append(errs, r.err.Error())
+				// Don't wait for the timer to try the next one.
+				if !next.Stop() {
+					select {
+					case <-next.C:
+					default:
+					}
+				}
+				next.Reset(0)
+				continue
+			}
+			go closeLosers(results, pending)
+			return r.conn, nil
+		}
+	}
+	return nil, errors.New(strings.Join(errs, "; "))
+}
+
+// closeLosers closes the connections of the pending dials which lose the race.
+func closeLosers(results <-chan dialResult, pending int) {
+	for ; pending > 0; pending-- {
+		if r := <-results; r.conn != nil {
+			r.conn.Close()
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package link
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	var b backoff
+	prev := time.Duration(0)
+	for i := 0; i < 20; i++ {
+		d := b.next()
+		max := minBackoff << i
+		if i >= 16 || max > maxBackoff {
+			max = maxBackoff
+		}
+		if d < max/2 || d > max {
+			t.Fatalf("backoff %v is %v, want [%v, %v]", i, d, max/2, max)
+		}
+		if i > 0 && max < maxBackoff && d < prev/2 {
+			t.Fatalf("backoff %v decreases from %v to %v", i, prev, d)
+		}
+		prev = d
+	}
+}
+
+func TestEndpointsDial(t *testing.T) {
+	// blocked.example is a black hole, refused.example fails at once, ok.example works.
+	dial := func(ctx context.Context, addr string) (net.Conn, error) {
+		switch addr {
+		case "blocked.example:443":
+			<-ctx.Done()
+			return nil, ctx.Err()
+		case "ok.example:443":
+			a, b := net.Pipe()
+			b.Close()
+			return a, nil
+		default:
+			return nil, errors.New("refused")
+		}
+	}
+	parse := func(s string) *endpoints {
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, err := newEndpoints(u, dial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Don't resolve the example names.
+		e.resolve = false
+		return e
+	}
+
+	e := parse("tls://blocked.example:443/?endpoints=refused.example:443,ok.example:443")
+	start := time.Now()
+	conn, err := e.Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if elapsed := time.Since(start); elapsed > 2*happyEyeballsDelay+100*time.Millisecond {
+		t.Fatalf("the dial takes %v", elapsed)
+	}
+
+	e = parse("tls://refused.example:443/?endpoints=refused.example:8443")
+	_, err = e.Dial(context.Background())
+	if err == nil {
+		t.Fatal("no error when all the endpoints fail")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	e = parse("tls://blocked.example:443/")
+	_, err = e.Dial(ctx)
+	if err == nil {
+		t.Fatal("no error when the context is canceled")
+	}
+}
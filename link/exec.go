@@ -0,0 +1,173 @@
+package link
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/clmul/cutevpn"
+)
+
+// newExec creates a link over the stdin and stdout of a command, like
+// exec://?cmd=ssh+server+cutevpn+-config+relay.toml+stdio.
+// The command is run by sh, and it's started again with backoff when it exits.
+// Its stderr is passed to the stderr of cutevpn.
+func newExec(vpn cutevpn.VPN, linkURL *url.URL, cipher cutevpn.Cipher) error {
+	config, err := parseStreamConfig(linkURL, cipher)
+	if err != nil {
+		return err
+	}
+	command := linkURL.Query().Get("cmd")
+	if command == "" {
+		return fmt.Errorf("exec needs cmd")
+	}
+	vpn.Loop(func(ctx context.Context) error {
+		return connect(ctx, vpn, func(ctx context.Context) (cutevpn.Link, error) {
+			conn, err := startCommand(command)
+			if err != nil {
+				return nil, err
+			}
+			return newStream(ctx, vpn, conn, newStreamFramer(conn, config.cipher), config, "exec", conn.LocalAddr(), command, command), nil
+		})
+	})
+	return nil
+}
+
+// newStdio creates a link over the stdin and stdout of cutevpn, which is the
+// other end of an exec link. cutevpn stops when the link is closed.
+func newStdio(vpn cutevpn.VPN, linkURL *url.URL, cipher cutevpn.Cipher) error {
+	config, err := parseStreamConfig(linkURL, cipher)
+	if err != nil {
+		return err
+	}
+	// The stdio must be non-blocking for deadlines.
+	for _, fd := range []int{0, 1} {
+		err := syscall.SetNonblock(fd, true)
+		if err != nil {
+			return err
+		}
+	}
+	conn := &pipeConn{
+		r:    os.NewFile(0, "stdin"),
+		w:    os.NewFile(1, "stdout"),
+		addr: pipeAddr("pid:" + strconv.Itoa(os.Getpid())),
+	}
+	vpn.Loop(func(ctx context.Context) error {
+		peer := newStream(ctx, vpn, conn, newStreamFramer(conn, config.cipher), config, "stdio", conn.LocalAddr(), "stdio", nil)
+		vpn.AddLink(peer)
+		<-peer.Done()
+		return errors.New("stdio is closed")
+	})
+	return nil
+}
+
+// startCommand starts command, and returns a connection to its stdin and stdout.
+// Closing the connection kills the command and its children.
+func startCommand(command string) (*pipeConn, error) {
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		stdinR.Close()
+		stdinW.Close()
+		return nil, err
+	}
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = stdinR
+	cmd.Stdout = stdoutW
+	cmd.Stderr = os.Stderr
+	// The command and its children are killed together as a process group.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	err = cmd.Start()
+	// The ends of the command are closed in the parent.
+	stdinR.Close()
+	stdoutW.Close()
+	if err != nil {
+		stdinW.Close()
+		stdoutR.Close()
+		return nil, err
+	}
+	log.Printf("started %q, pid %v", command, cmd.Process.Pid)
+	return &pipeConn{
+		r:    stdoutR,
+		w:    stdinW,
+		addr: pipeAddr("pid:" + strconv.Itoa(cmd.Process.Pid)),
+		onClose: func() {
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			err := cmd.Wait()
+			log.Printf("%q exited: %v", command, err)
+		},
+	}, nil
+}
+
+// pipeConn is a net.Conn over a pair of pipes.
+type pipeConn struct {
+	r, w    *os.File
+	addr    pipeAddr
+	onClose func()
+}
+
+func (c *pipeConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *pipeConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+func (c *pipeConn) Close() error {
+	err0 := c.r.Close()
+	err1 := c.w.Close()
+	if c.onClose != nil {
+		c.onClose()
+	}
+	if err0 != nil {
+		return err0
+	}
+	return err1
+}
+
+func (c *pipeConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	err := c.r.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.w.SetWriteDeadline(t)
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	return c.r.SetReadDeadline(t)
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	return c.w.SetWriteDeadline(t)
+}
+
+// pipeAddr is like "pid:1234", so the stream names it local:1234.
+type pipeAddr string
+
+func (a pipeAddr) Network() string {
+	return "pipe"
+}
+
+func (a pipeAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,118 @@
+package link
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/clmul/cutevpn"
+	"github.com/clmul/cutevpn/encryption"
+)
+
+func TestExecFraming(t *testing.T) {
+	// cat sends the packets back.
+	conn, err := startCommand("cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	f := newStreamFramer(conn, encryption.Plain{})
+	packets := readPackets(f)
+	sent := [][]byte{randomPacket(100), randomPacket(1400), randomPacket(1)}
+	err = f.WritePackets(sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range sent {
+		select {
+		case r := <-packets:
+			if !bytes.Equal(r, p) {
+				t.Fatal("the packet is changed")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+}
+
+func TestExecDeadline(t *testing.T) {
+	conn, err := startCommand("sleep 10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 10))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("the read returns %v", err)
+	}
+	start := time.Now()
+	conn.Close()
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("the command isn't killed")
+	}
+}
+
+// TestStdioHelper is the command of TestExecReconnect. It's the stdio end of an exec link,
+// which sends the packets back, and exits when it receives "exit".
+func TestStdioHelper(t *testing.T) {
+	if os.Getenv("CUTEVPN_STDIO_HELPER") == "" {
+		t.Skip("it's run by TestExecReconnect")
+	}
+	vpn := newTestVPN(context.Background())
+	newTestLink(t, vpn, "stdio://?secret=255a5b9021450fe59c4712f0e19c9607")
+	link := waitLink(t, vpn)
+	buffer := make([]byte, 2048)
+	for {
+		p, addr, err := link.Recv(buffer)
+		if err != nil || string(p) == "exit" {
+			os.Exit(0)
+		}
+		if len(p) > 0 {
+			link.Send(p, addr)
+		}
+	}
+}
+
+func TestExecReconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	vpn := newTestVPN(ctx)
+	command := fmt.Sprintf("CUTEVPN_STDIO_HELPER=1 exec %q -test.run=TestStdioHelper", os.Args[0])
+	newTestLink(t, vpn, "exec://?secret=255a5b9021450fe59c4712f0e19c9607&cmd="+url.QueryEscape(command))
+	echo := func(link cutevpn.Link) {
+		for i := 0; i < 10; i++ {
+			p := randomPacket(1000)
+			err := link.Send(append([]byte(nil), p...), link.Peer())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(recvPacket(t, link), p) {
+				t.Fatal("the packet is changed")
+			}
+		}
+	}
+	link := waitLink(t, vpn)
+	echo(link)
+
+	// The command exits, and it's started again.
+	err := link.Send([]byte("exit"), link.Peer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan struct{})
+	go func() {
+		closeOnError(link)
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the link of an exited command isn't closed")
+	}
+	echo(waitLink(t, vpn))
+}
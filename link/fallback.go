@@ -0,0 +1,56 @@
+package link
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const helloPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <title>Index Page</title>
+</head>
+<body>
+<h1>Hello, world!</h1>
+</body>
+</html>`
+
+// newFallbackHandler returns the handler of the clients without a verified certificate.
+//
+// fallback is an upstream website like http://127.0.0.1:8080, which the requests
+// are proxied to, or a directory of static files like /var/www or file:///var/www.
+// An empty fallback serves a hello page.
+func newFallbackHandler(fallback string) (http.Handler, error) {
+	if fallback == "" {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(helloPage))
+		}), nil
+	}
+	if strings.HasPrefix(fallback, "http://") || strings.HasPrefix(fallback, "https://") {
+		upstream, err := url.Parse(fallback)
+		if err != nil {
+			return nil, err
+		}
+		proxy := httputil.NewSingleHostReverseProxy(upstream)
+		proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+			log.Printf("fallback %v: %v", fallback, err)
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		return proxy, nil
+	}
+	dir := strings.TrimPrefix(fallback, "file://")
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("fallback %v is not a directory", dir)
+	}
+	return http.FileServer(http.Dir(dir)), nil
+}
@@ -0,0 +1,164 @@
+package link
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// get returns the status and the body of path served by h.
+func get(t *testing.T, h http.Handler, path string) (int, string) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	body, err := io.ReadAll(w.Result().Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, string(body)
+}
+
+func TestFallbackUpstream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "upstream "+req.URL.Path)
+	}))
+	h, err := newFallbackHandler(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, body := get(t, h, "/blog/post")
+	if code != http.StatusOK || body != "upstream /blog/post" {
+		t.Fatalf("the upstream answers %v %q", code, body)
+	}
+
+	upstream.Close()
+	code, _ = get(t, h, "/")
+	if code != http.StatusBadGateway {
+		t.Fatalf("a closed upstream answers %v", code)
+	}
+}
+
+func TestFallbackDirectory(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("<h1>blog</h1>"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fallback := range []string{dir, "file://" + dir} {
+		h, err := newFallbackHandler(fallback)
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, body := get(t, h, "/")
+		if code != http.StatusOK || body != "<h1>blog</h1>" {
+			t.Fatalf("%v answers %v %q", fallback, code, body)
+		}
+		code, _ = get(t, h, "/missing.html")
+		if code != http.StatusNotFound {
+			t.Fatalf("%v answers %v for a missing file", fallback, code)
+		}
+	}
+
+	for _, fallback := range []string{filepath.Join(dir, "index.html"), filepath.Join(dir, "missing")} {
+		_, err := newFallbackHandler(fallback)
+		if err == nil {
+			t.Fatalf("%v is accepted", fallback)
+		}
+	}
+}
+
+func TestFallbackHello(t *testing.T) {
+	h, err := newFallbackHandler("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, body := get(t, h, "/anything")
+	if code != http.StatusOK || body != helloPage {
+		t.Fatalf("the hello page is %v %q", code, body)
+	}
+}
+
+// writeCertificate writes a self-signed certificate of name to dir.
+func writeCertificate(t *testing.T, dir, name string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]*pem.Block{
+		"cert.pem": {Type: "CERTIFICATE", Bytes: der},
+		"key.pem":  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	}
+	for file, block := range files {
+		file = filepath.Join(dir, file)
+		err := os.WriteFile(file, pem.EncodeToMemory(block), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(file, modTime, modTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTLSFallback(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "upstream "+req.URL.Path)
+	}))
+	defer upstream.Close()
+	dir := t.TempDir()
+	writeCertificate(t, dir, "server", time.Now())
+	port := freePort(t)
+	cert, key := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	newTestLink(t, newTestVPN(ctx), fmt.Sprintf("tls://:%v/?cert=%v&key=%v&cacert=%v&fallback=%v",
+		port, cert, key, cert, url.QueryEscape(upstream.URL)))
+
+	// A client without a certificate sees the upstream website.
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	resp, err := client.Get(fmt.Sprintf("https://127.0.0.1:%v/index.html", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "upstream /index.html" {
+		t.Fatalf("the listener answers %q", body)
+	}
+}
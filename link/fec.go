@@ -0,0 +1,396 @@
+package link
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/clmul/cutevpn"
+)
+
+// fec is a forward error correction layer of datagram links.
+//
+// Packets are split into groups of at most k packets. The packets are sent
+// at once as data shards, and m parity shards of the group are sent after it.
+// The parity shards are a Reed-Solomon erasure code of the data shards, so the
+// receiver recovers a group from any k of its k+m shards.
+//
+// A data shard is the group id, the index, and the packet.
+// A parity shard is the group id, 0x80|index, k, and the parity of the
+// length-prefixed packets, which are padded to the same length.
+type fec struct {
+	k, m int
+	// write sends a shard to dst
+	write func(shard []byte, dst cutevpn.LinkAddr) error
+
+	// The encoders are used by Send and the flush timers.
+	lock     sync.Mutex
+	encoders map[cutevpn.LinkAddr]*fecEncoder
+
+	// The decoders and the recovered packets are only accessed by Recv.
+	decoders  map[cutevpn.LinkAddr]*fecDecoder
+	recovered []fecPacket
+}
+
+type fecPacket struct {
+	payload []byte
+	src     cutevpn.LinkAddr
+}
+
+const (
+	fecDataHeaderLen   = 5
+	fecParityHeaderLen = 6
+	fecParityFlag      = 0x80
+	// The parity of an incomplete group is sent after fecFlushDelay.
+	fecFlushDelay = 20 * time.Millisecond
+	// Groups older than the latest group by fecWindow are forgotten.
+	fecWindow = 16
+)
+
+var errFECShard = errors.New("invalid FEC shard")
+
+// parseFEC parses the fec= parameter, which is like "8:2" for groups of
+// 8 data shards and 2 parity shards. It returns nil if fec is empty.
+func parseFEC(s string, write func(shard []byte, dst cutevpn.LinkAddr) error) (*fec, error) {
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid fec %v", s)
+	}
+	k, err0 := strconv.Atoi(parts[0])
+	m, err1 := strconv.Atoi(parts[1])
+	if err0 != nil || err1 != nil || k <= 0 || m <= 0 || k >= fecParityFlag || m >= fecParityFlag {
+		return nil, fmt.Errorf("invalid fec %v", s)
+	}
+	return &fec{
+		k:        k,
+		m:        m,
+		write:    write,
+		encoders: make(map[cutevpn.LinkAddr]*fecEncoder),
+		decoders: make(map[cutevpn.LinkAddr]*fecDecoder),
+	}, nil
+}
+
+// Overhead is the max bytes added to a packet.
+func (f *fec) Overhead() int {
+	return fecParityHeaderLen + 2
+}
+
+type fecEncoder struct {
+	group  uint32
+	shards [][]byte
+	timer  *time.Timer
+}
+
+// Send sends packet as a data shard, and the parity shards if the group is complete.
+func (f *fec) Send(packet []byte, dst cutevpn.LinkAddr) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	enc, ok := f.encoders[dst]
+	if !ok {
+		enc = &fecEncoder{}
+		f.encoders[dst] = enc
+	}
+	index := len(enc.shards)
+	shard := make([]byte, 2, 2+len(packet))
+	binary.BigEndian.PutUint16(shard, uint16(len(packet)))
+	enc.shards = append(enc.shards, append(shard, packet...))
+
+	data := make([]byte, fecDataHeaderLen, fecDataHeaderLen+len(packet))
+	binary.BigEndian.PutUint32(data, enc.group)
+	data[4] = byte(index)
+	err := f.write(append(data, packet...), dst)
+	if err != nil {
+		return err
+	}
+
+	if len(enc.shards) == f.k {
+		return f.flush(enc, dst)
+	}
+	if index == 0 {
+		group := enc.group
+		enc.timer = time.AfterFunc(fecFlushDelay, func() {
+			f.lock.Lock()
+			defer f.lock.Unlock()
+			if enc.group == group && len(enc.shards) > 0 {
+				f.flush(enc, dst)
+			}
+		})
+	}
+	return nil
+}
+
+// flush sends the parity shards of the current group and starts a new group.
+func (f *fec) flush(enc *fecEncoder, dst cutevpn.LinkAddr) error {
+	if enc.timer != nil {
+		enc.timer.Stop()
+		enc.timer = nil
+	}
+	parity := rsEncode(enc.shards, f.m)
+	k := len(enc.shards)
+	group := enc.group
+	enc.group++
+	enc.shards = enc.shards[:0]
+	for j, p := range parity {
+		shard := make([]byte, fecParityHeaderLen, fecParityHeaderLen+len(p))
+		binary.BigEndian.PutUint32(shard, group)
+		shard[4] = fecParityFlag | byte(j)
+		shard[5] = byte(k)
+		err := f.write(append(shard, p...), dst)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type fecDecoder struct {
+	latest uint32
+	groups map[uint32]*fecGroup
+}
+
+type fecGroup struct {
+	// 0 until a parity shard is received
+	k         int
+	data      map[int][]byte
+	parity    map[int][]byte
+	recovered bool
+}
+
+// Recovered returns a packet recovered by Decode, or nil.
+func (f *fec) Recovered() (fecPacket, bool) {
+	if len(f.recovered) == 0 {
+		return fecPacket{}, false
+	}
+	p := f.recovered[0]
+	f.recovered = f.recovered[1:]
+	return p, true
+}
+
+// Decode handles a shard from src. It returns the packet of a data shard,
+// or nil for a parity shard. The packets recovered by the shard are
+// returned by Recovered later.
+func (f *fec) Decode(shard []byte, src cutevpn.LinkAddr) ([]byte, error) {
+	if len(shard) < fecDataHeaderLen {
+		return nil, errFECShard
+	}
+	dec, ok := f.decoders[src]
+	if !ok {
+		dec = &fecDecoder{groups: make(map[uint32]*fecGroup)}
+		f.decoders[src] = dec
+	}
+	id := binary.BigEndian.Uint32(shard)
+	if int32(id-dec.latest) > 0 {
+		dec.latest = id
+		for old := range dec.groups {
+			if int32(id-old) > fecWindow {
+				delete(dec.groups, old)
+			}
+		}
+	} else if int32(dec.latest-id) > fecWindow {
+		// It's too old to be useful.
+		if shard[4]&fecParityFlag == 0 {
+			return shard[fecDataHeaderLen:], nil
+		}
+		return nil, nil
+	}
+	group, ok := dec.groups[id]
+	if !ok {
+		group = &fecGroup{data: make(map[int][]byte), parity: make(map[int][]byte)}
+		dec.groups[id] = group
+	}
+
+	var packet []byte
+	if shard[4]&fecParityFlag == 0 {
+		packet = shard[fecDataHeaderLen:]
+		b := make([]byte, 2, 2+len(packet))
+		binary.BigEndian.PutUint16(b, uint16(len(packet)))
+		group.data[int(shard[4])] = append(b, packet...)
+	} else {
+		if len(shard) < fecParityHeaderLen {
+			return nil, errFECShard
+		}
+		k := int(shard[5])
+		if k == 0 || k >= fecParityFlag || (group.k != 0 && group.k != k) {
+			return nil, errFECShard
+		}
+		group.k = k
+		group.parity[int(shard[4]&^fecParityFlag)] = append([]byte(nil), shard[fecParityHeaderLen:]...)
+	}
+	f.recover(group, src)
+	return packet, nil
+}
+
+func (f *fec) recover(group *fecGroup, src cutevpn.LinkAddr) {
+	if group.recovered || group.k == 0 || len(group.data) >= group.k || len(group.data)+len(group.parity) < group.k {
+		return
+	}
+	group.recovered = true
+	shards, err := rsDecode(group.k, group.data, group.parity)
+	if err != nil {
+		return
+	}
+	for i, shard := range shards {
+		if _, ok := group.data[i]; ok {
+			continue
+		}
+		if len(shard) < 2 {
+			continue
+		}
+		n := int(binary.BigEndian.Uint16(shard))
+		if n > len(shard)-2 {
+			continue
+		}
+		f.recovered = append(f.recovered, fecPacket{payload: shard[2 : 2+n], src: src})
+	}
+}
+
+// The arithmetic of GF(2^8) with the polynomial x^8+x^4+x^3+x^2+1.
+var gfExp [510]byte
+var gfLog [256]int
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfExp[i+255] = byte(x)
+		gfLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a]+gfLog[b]]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-gfLog[a]]
+}
+
+// cauchy is the coefficient of data shard i in parity shard j.
+// Every square submatrix of a Cauchy matrix is invertible.
+func cauchy(j, i int) byte {
+	return gfInv(byte(255-j) ^ byte(i))
+}
+
+// rsEncode returns m parity shards of the data shards.
+func rsEncode(data [][]byte, m int) [][]byte {
+	size := 0
+	for _, d := range data {
+		if len(d) > size {
+			size = len(d)
+		}
+	}
+	parity := make([][]byte, m)
+	for j := range parity {
+		p := make([]byte, size)
+		for i, d := range data {
+			c := cauchy(j, i)
+			for n, b := range d {
+				p[n] ^= gfMul(c, b)
+			}
+		}
+		parity[j] = p
+	}
+	return parity
+}
+
+// rsDecode recovers all k data shards from the received data and parity shards.
+// At least k shards must be received.
+func rsDecode(k int, data map[int][]byte, parity map[int][]byte) ([][]byte, error) {
+	var missing []int
+	for i := 0; i < k; i++ {
+		if _, ok := data[i]; !ok {
+			missing = append(missing, i)
+		}
+	}
+	var rows []int
+	size := 0
+	for j, p := range parity {
+		if len(rows) == len(missing) {
+			break
+		}
+		rows = append(rows, j)
+		size = len(p)
+	}
+	if len(rows) < len(missing) {
+		return nil, errFECShard
+	}
+
+	// Subtract the received data shards from the parity shards, then
+	// solve a[r][c] * missing[c] = b[r], a is a Cauchy matrix.
+	e := len(missing)
+	a := make([][]byte, e)
+	b := make([][]byte, e)
+	for r, j := range rows {
+		if len(parity[j]) != size {
+			return nil, errFECShard
+		}
+		b[r] = append([]byte(nil), parity[j]...)
+		for i, d := range data {
+			if i >= k || len(d) > size {
+				return nil, errFECShard
+			}
+			c := cauchy(j, i)
+			for n, v := range d {
+				b[r][n] ^= gfMul(c, v)
+			}
+		}
+		a[r] = make([]byte, e)
+		for col, i := range missing {
+			a[r][col] = cauchy(j, i)
+		}
+	}
+	// Gauss-Jordan elimination
+	for col := 0; col < e; col++ {
+		pivot := col
+		for pivot < e && a[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == e {
+			return nil, errFECShard
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		b[col], b[pivot] = b[pivot], b[col]
+		inv := gfInv(a[col][col])
+		for c := range a[col] {
+			a[col][c] = gfMul(a[col][c], inv)
+		}
+		for n := range b[col] {
+			b[col][n] = gfMul(b[col][n], inv)
+		}
+		for r := 0; r < e; r++ {
+			if r == col || a[r][col] == 0 {
+				continue
+			}
+			factor := a[r][col]
+			for c := range a[r] {
+				a[r][c] ^= gfMul(factor, a[col][c])
+			}
+			for n := range b[r] {
+				b[r][n] ^= gfMul(factor, b[col][n])
+			}
+		}
+	}
+
+	shards := make([][]byte, k)
+	for i, d := range data {
+		shards[i] = d
+	}
+	for col, i := range missing {
+		shards[i] = b[col]
+	}
+	return shards, nil
+}
@@ -0,0 +1,104 @@
+package link
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/clmul/cutevpn"
+)
+
+func TestFECRecovery(t *testing.T) {
+	const k, m = 8, 3
+	var shards [][]byte
+	f, err := parseFEC("8:3", func(shard []byte, dst cutevpn.LinkAddr) error {
+		shards = append(shards, append([]byte(nil), shard...))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, _ := parseFEC("8:3", nil)
+
+	for group := 0; group < 100; group++ {
+		shards = shards[:0]
+		var sent [][]byte
+		for i := 0; i < k; i++ {
+			p := randomPacket(rand.Intn(1400))
+			sent = append(sent, p)
+			err := f.Send(append([]byte(nil), p...), "peer")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(shards) != k+m {
+			t.Fatalf("%v shards are sent, want %v", len(shards), k+m)
+		}
+
+		// lose up to m shards of the group
+		lost := make(map[int]bool)
+		for _, i := range rand.Perm(k + m)[:rand.Intn(m+1)] {
+			lost[i] = true
+		}
+		received := make(map[string]bool)
+		for i, shard := range shards {
+			if lost[i] {
+				continue
+			}
+			p, err := g.Decode(shard, "peer")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p != nil {
+				received[string(p)] = true
+			}
+			for {
+				r, ok := g.Recovered()
+				if !ok {
+					break
+				}
+				if r.src != "peer" {
+					t.Fatalf("recovered from %v", r.src)
+				}
+				received[string(r.payload)] = true
+			}
+		}
+		for i, p := range sent {
+			if !received[string(p)] {
+				t.Fatalf("group %v: packet %v is lost, lost shards %v", group, i, lost)
+			}
+		}
+	}
+}
+
+func TestFECPartialGroup(t *testing.T) {
+	done := make(chan [][]byte, 1)
+	var shards [][]byte
+	f, _ := parseFEC("4:1", func(shard []byte, dst cutevpn.LinkAddr) error {
+		shards = append(shards, append([]byte(nil), shard...))
+		if len(shards) == 3 {
+			done <- shards
+		}
+		return nil
+	})
+	g, _ := parseFEC("4:1", nil)
+
+	a, b := randomPacket(100), randomPacket(200)
+	f.Send(append([]byte(nil), a...), "peer")
+	f.Send(append([]byte(nil), b...), "peer")
+	// the parity is sent by the flush timer
+	shards = <-done
+
+	_, err := g.Decode(shards[1], "peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = g.Decode(shards[2], "peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, ok := g.Recovered()
+	if !ok || !bytes.Equal(r.payload, a) {
+		t.Fatal("the first packet isn't recovered")
+	}
+}
@@ -0,0 +1,173 @@
+package link
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/clmul/cutevpn"
+)
+
+// Framing versions of stream links.
+// Version 0 delimits packets by a separator which doesn't appear in the packet.
+// Version 1 prefixes every packet with its length.
+const (
+	framingSep    = 0
+	framingLength = 1
+
+	framingLatest = framingLength
+)
+
+// A control message is a signal, see signalSize.
+const controlSize = signalSize
+
+var controlMagic = []byte("cutevpn")
+
+const (
+	controlHello  = 'h'
+	controlSwitch = 's'
+)
+
+// streamFramer reads and writes packets on a byte stream.
+//
+// Both ends start with version 0. Each end sends a hello message with the
+// latest version it supports before its first packet. After receiving the hello
+// of the other end, it sends a switch message, and the packets after it use the
+// negotiated version. So a peer which only supports version 0 still works.
+//
+// WritePackets and ReadPacket may be called concurrently,
+// but each of them must be called by only one goroutine.
+type streamFramer struct {
+	w      io.Writer
+	cipher cutevpn.Cipher
+
+	// accessed by the writer
+	helloSent    bool
+	writeVersion byte
+	wbuf         []byte
+
+	// accessed by the reader
+	scanner     *bufio.Scanner
+	readVersion byte
+
+	// the version which the other end supports, sent by the reader to the writer
+	peerVersion chan byte
+}
+
+func newStreamFramer(rw io.ReadWriter, cipher cutevpn.Cipher) *streamFramer {
+	f := &streamFramer{
+		w:           rw,
+		cipher:      cipher,
+		wbuf:        make([]byte, 0, 2048),
+		scanner:     bufio.NewScanner(rw),
+		peerVersion: make(chan byte, 1),
+	}
+	f.scanner.Split(f.split)
+	return f
+}
+
+// WritePackets writes all the packets with one Write.
+func (f *streamFramer) WritePackets(packets [][]byte) error {
+	f.wbuf = f.wbuf[:0]
+	if !f.helloSent {
+		f.appendControl(controlHello, framingLatest)
+		f.helloSent = true
+	}
+	if f.writeVersion == framingSep {
+		select {
+		case version := <-f.peerVersion:
+			if version > framingLatest {
+				version = framingLatest
+			}
+			if version != framingSep {
+				f.appendControl(controlSwitch, version)
+				f.writeVersion = version
+			}
+		default:
+		}
+	}
+	for _, packet := range packets {
+		f.appendPacket(packet)
+	}
+	_, err := f.w.Write(f.wbuf)
+	return err
+}
+
+func (f *streamFramer) appendPacket(packet []byte) {
+	switch f.writeVersion {
+	case framingLength:
+		f.wbuf = append(f.wbuf, byte(len(packet)>>8), byte(len(packet)))
+		f.wbuf = append(f.wbuf, packet...)
+	default:
+		f.wbuf = appendSep(f.wbuf, packet)
+	}
+}
+
+func (f *streamFramer) appendControl(typ, version byte) {
+	msg := make([]byte, 0, controlSize+f.cipher.Overhead())
+	msg = append(msg, controlMagic...)
+	msg = append(msg, typ, version)
+	f.appendPacket(f.cipher.Encrypt(msg))
+}
+
+func (f *streamFramer) ReadPacket(buffer []byte) ([]byte, error) {
+	for {
+		if !f.scanner.Scan() {
+			err := f.scanner.Err()
+			if err == nil {
+				err = io.EOF
+			}
+			return nil, err
+		}
+		p := f.scanner.Bytes()
+		if f.readVersion == framingSep && len(p) == controlSize+f.cipher.Overhead() {
+			typ, version, ok := f.readControl(p)
+			if ok {
+				switch typ {
+				case controlHello:
+					select {
+					case f.peerVersion <- version:
+					default:
+					}
+				case controlSwitch:
+					if version <= framingLatest {
+						f.readVersion = version
+					}
+				}
+				continue
+			}
+		}
+		n := copy(buffer, p)
+		return buffer[:n], nil
+	}
+}
+
+func (f *streamFramer) readControl(p []byte) (typ, version byte, ok bool) {
+	msg, err := f.cipher.Decrypt(append([]byte(nil), p...))
+	if err != nil || len(msg) != controlSize || !bytes.HasPrefix(msg, controlMagic) {
+		return 0, 0, false
+	}
+	return msg[len(controlMagic)], msg[len(controlMagic)+1], true
+}
+
+func (f *streamFramer) split(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if f.readVersion == framingLength {
+		return splitLength(data, atEOF)
+	}
+	return split(data, atEOF)
+}
+
+func splitLength(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	if len(data) < 2 {
+		return 0, nil, nil
+	}
+	n := int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+n {
+		return 0, nil, nil
+	}
+	return 2 + n, data[2 : 2+n], nil
+}
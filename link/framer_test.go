@@ -0,0 +1,133 @@
+package link
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/clmul/cutevpn"
+	"github.com/clmul/cutevpn/encryption"
+)
+
+// readPackets reads packets from f and sends copies of them to the returned channel.
+func readPackets(f *streamFramer) <-chan []byte {
+	ch := make(chan []byte)
+	go func() {
+		defer close(ch)
+		buffer := make([]byte, 2048)
+		for {
+			p, err := f.ReadPacket(buffer)
+			if err != nil {
+				return
+			}
+			ch <- append([]byte(nil), p...)
+		}
+	}()
+	return ch
+}
+
+func TestStreamFramerNegotiation(t *testing.T) {
+	aesgcm, err := encryption.NewAESGCM("255a5b9021450fe59c4712f0e19c9607")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphers := map[string]cutevpn.Cipher{
+		"plain":  encryption.Plain{},
+		"aesgcm": aesgcm,
+	}
+	for name, cipher := range ciphers {
+		t.Run(name, func(t *testing.T) {
+			conn0, conn1 := net.Pipe()
+			defer conn0.Close()
+			defer conn1.Close()
+			f0 := newStreamFramer(conn0, cipher)
+			f1 := newStreamFramer(conn1, cipher)
+			in0, in1 := readPackets(f0), readPackets(f1)
+			for i := 0; i < 4; i++ {
+				p := randomPacket(100 + i)
+				go f0.WritePackets([][]byte{p})
+				if q := <-in1; !bytes.Equal(p, q) {
+					t.Fatalf("packet %v is wrong", i)
+				}
+				p = randomPacket(200 + i)
+				go f1.WritePackets([][]byte{p})
+				if q := <-in0; !bytes.Equal(p, q) {
+					t.Fatalf("packet %v is wrong", i)
+				}
+			}
+			if f0.writeVersion != framingLength || f1.writeVersion != framingLength {
+				t.Errorf("expect version %v, got %v and %v", framingLength, f0.writeVersion, f1.writeVersion)
+			}
+		})
+	}
+}
+
+func TestStreamFramerOldPeer(t *testing.T) {
+	conn0, conn1 := net.Pipe()
+	defer conn0.Close()
+	defer conn1.Close()
+	f := newStreamFramer(conn0, encryption.Plain{})
+	in := readPackets(f)
+
+	// The old peer reads the hello message as an empty packet and never replies to it.
+	old := bufio.NewScanner(conn1)
+	old.Split(split)
+	for i := 0; i < 4; i++ {
+		p := randomPacket(100 + i)
+		go f.WritePackets([][]byte{p})
+		if i == 0 {
+			if !old.Scan() || len(old.Bytes()) != controlSize {
+				t.Fatal("expect a hello message")
+			}
+		}
+		if !old.Scan() || !bytes.Equal(old.Bytes(), p) {
+			t.Fatalf("packet %v is wrong", i)
+		}
+
+		p = randomPacket(200 + i)
+		go conn1.Write(appendSep(nil, p))
+		if q := <-in; !bytes.Equal(p, q) {
+			t.Fatalf("packet %v is wrong", i)
+		}
+	}
+	if f.writeVersion != framingSep {
+		t.Errorf("expect version %v, got %v", framingSep, f.writeVersion)
+	}
+}
+
+func benchmarkFraming(b *testing.B, version byte, size int) {
+	var buf bytes.Buffer
+	f := newStreamFramer(&buf, encryption.Plain{})
+	f.helloSent = true
+	f.writeVersion = version
+	f.readVersion = version
+	packets := [][]byte{randomPacket(size)}
+	buffer := make([]byte, 2048)
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := f.WritePackets(packets)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, err = f.ReadPacket(buffer)
+		if err != nil && err != io.EOF {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFraming(b *testing.B) {
+	for _, size := range []int{64, 512, 1400} {
+		b.Run(fmt.Sprintf("sep/%v", size), func(b *testing.B) {
+			benchmarkFraming(b, framingSep, size)
+		})
+		b.Run(fmt.Sprintf("length/%v", size), func(b *testing.B) {
+			benchmarkFraming(b, framingLength, size)
+		})
+	}
+}
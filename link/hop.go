@@ -0,0 +1,256 @@
+package link
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/clmul/cutevpn"
+)
+
+// hopConfig is the port hopping of a UDP link.
+//
+// Time is split into slots of interval. The port of a slot is chosen from
+// [low, high] by the HMAC of the slot number with the secret, so both ends
+// know the port without talking about it, and a long-lived UDP flow becomes
+// many short flows. With a list of secrets, the oldest one is used, which
+// every node has while the secrets are rotated.
+type hopConfig struct {
+	keys      *keySet
+	interval  time.Duration
+	low, high int
+}
+
+// parseHop parses the hop= interval and the ports= range like "40000-40999".
+// It returns nil if hop is empty.
+func parseHop(linkURL *url.URL, keys *keySet) (*hopConfig, error) {
+	query := linkURL.Query()
+	if query.Get("hop") == "" {
+		return nil, nil
+	}
+	interval, err := time.ParseDuration(query.Get("hop"))
+	if err != nil {
+		return nil, err
+	}
+	if interval < time.Second {
+		return nil, fmt.Errorf("hop interval %v is too short", interval)
+	}
+	if keys == nil {
+		return nil, fmt.Errorf("hop needs a secret")
+	}
+	ports := query.Get("ports")
+	bounds := strings.Split(ports, "-")
+	if len(bounds) != 2 {
+		return nil, fmt.Errorf("invalid ports %q", ports)
+	}
+	low, err0 := strconv.Atoi(bounds[0])
+	high, err1 := strconv.Atoi(bounds[1])
+	if err0 != nil || err1 != nil || low <= 0 || high > 65535 || low > high {
+		return nil, fmt.Errorf("invalid ports %q", ports)
+	}
+	return &hopConfig{
+		keys:     keys,
+		interval: interval,
+		low:      low,
+		high:     high,
+	}, nil
+}
+
+func (h *hopConfig) slot(t time.Time) int64 {
+	return t.UnixNano() / int64(h.interval)
+}
+
+func (h *hopConfig) port(slot int64) int {
+	mac := hmac.New(sha256.New, []byte(h.keys.oldest()))
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(slot))
+	mac.Write([]byte("cutevpn hop"))
+	mac.Write(b[:])
+	sum := binary.BigEndian.Uint32(mac.Sum(nil))
+	return h.low + int(sum%uint32(h.high-h.low+1))
+}
+
+// currentPort is the port the dialer sends to.
+func (h *hopConfig) currentPort() int {
+	return h.port(h.slot(time.Now()))
+}
+
+func (h *hopConfig) String() string {
+	return fmt.Sprintf("%v-%v", h.low, h.high)
+}
+
+// hopListener listens on the ports of the previous, the current and the next
+// slots, so the clocks of the ends may differ by an interval.
+type hopListener struct {
+	vpn    cutevpn.VPN
+	config *hopConfig
+	host   string
+	ctx    context.Context
+	in     chan hopPacket
+
+	lock  sync.Mutex
+	conns map[int]*net.UDPConn
+	// the socket which received the last packet from an address,
+	// replies are sent from it to get through NAT.
+	replies map[AddrPort]*net.UDPConn
+}
+
+type hopPacket struct {
+	payload []byte
+	src     *net.UDPAddr
+	conn    *net.UDPConn
+}
+
+func newHopListener(vpn cutevpn.VPN, ctx context.Context, config *hopConfig, host string) (*hopListener, error) {
+	h := &hopListener{
+		vpn:     vpn,
+		config:  config,
+		host:    host,
+		ctx:     ctx,
+		in:      make(chan hopPacket),
+		conns:   make(map[int]*net.UDPConn),
+		replies: make(map[AddrPort]*net.UDPConn),
+	}
+	err := h.rotate()
+	if err != nil {
+		h.close()
+		return nil, err
+	}
+	vpn.OnCancel(ctx, h.close)
+	vpn.Go(func() {
+		for {
+			now := time.Now()
+			next := time.Unix(0, (config.slot(now)+1)*int64(config.interval))
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(next.Sub(now)):
+			}
+			err := h.rotate()
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	})
+	return h, nil
+}
+
+// rotate opens the sockets of the slots around now, and closes the others.
+// It returns an error if the socket of the current slot can't be opened.
+func (h *hopListener) rotate() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.ctx.Err() != nil {
+		return nil
+	}
+	slot := h.config.slot(time.Now())
+	current := h.config.port(slot)
+	ports := map[int]bool{
+		h.config.port(slot - 1): true,
+		current:                 true,
+		h.config.port(slot + 1): true,
+	}
+	for port, c := range h.conns {
+		if ports[port] {
+			continue
+		}
+		c.Close()
+		delete(h.conns, port)
+		for addr, reply := range h.replies {
+			if reply == c {
+				delete(h.replies, addr)
+			}
+		}
+	}
+	var err error
+	for port := range ports {
+		if _, ok := h.conns[port]; ok {
+			continue
+		}
+		c, e := net.ListenPacket("udp", net.JoinHostPort(h.host, strconv.Itoa(port)))
+		if e != nil {
+			if port == current {
+				err = e
+			} else {
+				log.Println(e)
+			}
+			continue
+		}
+		conn := c.(*net.UDPConn)
+		h.conns[port] = conn
+		h.vpn.Go(func() {
+			h.read(conn)
+		})
+	}
+	return err
+}
+
+func (h *hopListener) read(conn *net.UDPConn) {
+	for {
+		buffer := make([]byte, 2048)
+		n, src, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			// the socket is closed by rotate or close
+			return
+		}
+		select {
+		case h.in <- hopPacket{payload: buffer[:n], src: src, conn: conn}:
+		case <-h.ctx.Done():
+			return
+		}
+	}
+}
+
+func (h *hopListener) close() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for port, c := range h.conns {
+		err := c.Close()
+		if err != nil {
+			log.Println(err)
+		}
+		delete(h.conns, port)
+	}
+}
+
+func (h *hopListener) ReadFromUDP(buffer []byte) (int, *net.UDPAddr, error) {
+	select {
+	case <-h.ctx.Done():
+		return 0, nil, h.ctx.Err()
+	case p := <-h.in:
+		h.lock.Lock()
+		for _, c := range h.conns {
+			if c == p.conn {
+				h.replies[convertNetAddr(p.src.IP, p.src.Port)] = p.conn
+			}
+		}
+		h.lock.Unlock()
+		return copy(buffer, p.payload), p.src, nil
+	}
+}
+
+func (h *hopListener) WriteToUDP(packet []byte, addr *net.UDPAddr) (int, error) {
+	h.lock.Lock()
+	conn, ok := h.replies[convertNetAddr(addr.IP, addr.Port)]
+	if !ok {
+		conn, ok = h.conns[h.config.currentPort()]
+	}
+	h.lock.Unlock()
+	if !ok {
+		return 0, fmt.Errorf("no socket to send to %v", addr)
+	}
+	return conn.WriteToUDP(packet, addr)
+}
+
+func (h *hopListener) String() string {
+	return net.JoinHostPort(h.host, h.config.String())
+}
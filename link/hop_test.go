@@ -0,0 +1,78 @@
+package link
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestHopPort(t *testing.T) {
+	parse := func(s string) *hopConfig {
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := parseHop(u, testKeys(t, u))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	listener := parse("udp://:0?hop=1m&ports=40000-40099&secret=1234")
+	dialer := parse("udp://server?hop=1m&ports=40000-40099&secret=1234")
+	other := parse("udp://server?hop=1m&ports=40000-40099&secret=5678")
+
+	ports := make(map[int]bool)
+	same := 0
+	for slot := int64(0); slot < 1000; slot++ {
+		port := listener.port(slot)
+		if port < 40000 || port > 40099 {
+			t.Fatalf("port %v is out of range", port)
+		}
+		if dialer.port(slot) != port {
+			t.Fatalf("the ends choose different ports in slot %v", slot)
+		}
+		if other.port(slot) == port {
+			same++
+		}
+		ports[port] = true
+	}
+	if len(ports) < 90 {
+		t.Fatalf("only %v ports are used", len(ports))
+	}
+	if same > 50 {
+		t.Fatalf("the ports don't depend on the secret")
+	}
+
+	// A node which has a new secret still chooses the ports of the old one.
+	rotated := parse("udp://server?hop=1m&ports=40000-40099&secret=5678,1234")
+	for slot := int64(0); slot < 100; slot++ {
+		if rotated.port(slot) != listener.port(slot) {
+			t.Fatalf("the ends choose different ports in slot %v while the secret is rotated", slot)
+		}
+	}
+
+	for _, s := range []string{
+		"udp://:0?hop=1m&ports=40000-40099",
+		"udp://:0?hop=1m&ports=40000&secret=1234",
+		"udp://:0?hop=1m&ports=40099-40000&secret=1234",
+		"udp://:0?hop=1ms&ports=40000-40099&secret=1234",
+	} {
+		u, _ := url.Parse(s)
+		_, err := parseHop(u, testKeys(t, u))
+		if err == nil {
+			t.Fatalf("%v is accepted", s)
+		}
+	}
+}
+
+// testKeys returns the keys of the secrets of u, or nil if it has no secret.
+func testKeys(t *testing.T, u *url.URL) *keySet {
+	secrets, err := loadSecrets(u.Query())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secrets == nil {
+		return nil
+	}
+	return &keySet{keys: secrets}
+}
@@ -0,0 +1,434 @@
+package link
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/clmul/cutevpn"
+)
+
+// An HTTP link carries packets in the bodies of POST requests and responses,
+// so it works through HTTP proxies and CDNs which don't support WebSocket.
+//
+// The dialer opens a session with a random ID, which is sent in a header of
+// every request. It keeps a poll request with an empty body, which is held by
+// the server until there are packets for the dialer, and sends the packets
+// to the server in other requests. The responses of both carry packets to the dialer.
+//
+// A body is a sequence of encrypted packets, every packet has a 2-byte length before it.
+// The session expires if there are no requests in httpSessionTimeout.
+
+const (
+	httpSessionHeader = "X-Session-Id"
+	// The max time the server holds a poll request.
+	httpPollTimeout = 10 * time.Second
+	// A session is closed if there are no requests in it.
+	httpSessionTimeout = 30 * time.Second
+	// The max bytes of packets in a body.
+	httpMaxBatch = 64 * 1024
+	httpMaxBody  = 1 << 20
+	// The dialer gives up a session after the requests fail so many times in a row.
+	httpMaxFailures = 3
+	// The default queue of an HTTP link is longer than a stream, because
+	// the packets wait for the next request.
+	httpDefaultQueue = 64
+)
+
+var errHTTPBody = errors.New("invalid HTTP link body")
+
+func parseHTTPConfig(linkURL *url.URL, cipher cutevpn.Cipher) (streamConfig, error) {
+	config, err := parseStreamConfig(linkURL, cipher)
+	if err != nil {
+		return config, err
+	}
+	if linkURL.Query().Get("queue") == "" {
+		config.queue = httpDefaultQueue
+	}
+	return config, nil
+}
+
+// drain takes the queued packets for a body. If the queue is empty, it waits
+// for a packet at most wait, or forever if wait is negative.
+func (l *pollLink) drain(ctx context.Context, wait time.Duration) [][]byte {
+	var packets [][]byte
+	if wait != 0 {
+		var timeout <-chan time.Time
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case p := <-l.out:
+			packets = append(packets, p)
+		case <-timeout:
+			return nil
+		case <-ctx.Done():
+			return nil
+		case <-l.ctx.Done():
+			return nil
+		}
+	}
+	size := 0
+	for size < httpMaxBatch {
+		select {
+		case p := <-l.out:
+			packets = append(packets, p)
+			size += len(p)
+		default:
+			return packets
+		}
+	}
+	return packets
+}
+
+func encodeHTTPBody(packets [][]byte) []byte {
+	var body []byte
+	for _, p := range packets {
+		var length [2]byte
+		binary.BigEndian.PutUint16(length[:], uint16(len(p)))
+		body = append(body, length[:]...)
+		body = append(body, p...)
+	}
+	return body
+}
+
+func decodeHTTPBody(body []byte) ([][]byte, error) {
+	var packets [][]byte
+	for len(body) > 0 {
+		if len(body) < 2 {
+			return nil, errHTTPBody
+		}
+		n := int(binary.BigEndian.Uint16(body))
+		if len(body) < 2+n {
+			return nil, errHTTPBody
+		}
+		packets = append(packets, body[2:2+n])
+		body = body[2+n:]
+	}
+	return packets, nil
+}
+
+// httpServer serves the sessions of HTTP links on path.
+// Other requests, and the requests of unknown sessions without a valid packet,
+// are served by fallback, so the server looks like the fallback website.
+type httpServer struct {
+	vpn      cutevpn.VPN
+	path     string
+	config   streamConfig
+	kind     string
+	fallback http.Handler
+
+	lock     sync.Mutex
+	sessions map[string]*pollLink
+}
+
+func newHTTPServer(vpn cutevpn.VPN, path string, config streamConfig, kind string, fallback http.Handler) *httpServer {
+	return &httpServer{
+		vpn:      vpn,
+		path:     path,
+		config:   config,
+		kind:     kind,
+		fallback: fallback,
+		sessions: make(map[string]*pollLink),
+	}
+}
+
+func (s *httpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	id := req.Header.Get(httpSessionHeader)
+	if req.Method != http.MethodPost || req.URL.Path != s.path || len(id) < 8 {
+		s.fallback.ServeHTTP(w, req)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, httpMaxBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	packets, err := decodeHTTPBody(body)
+	link, opened := s.session(id, req, packets, err)
+	if link == nil {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		s.fallback.ServeHTTP(w, req)
+		return
+	}
+	if err != nil {
+		// The body of a session is truncated or broken.
+		link.stats.AddDecryptError()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	atomic.StoreInt64(&link.lastSeen, time.Now().UnixNano())
+	if opened {
+		// The first packet is already decrypted by session, with replay it would be rejected again.
+		link.receive(req.Context(), packets[1:])
+	} else {
+		link.receive(req.Context(), packets)
+	}
+
+	// A request with packets is answered at once, and a poll request is held.
+	wait := time.Duration(0)
+	if len(packets) == 0 {
+		wait = httpPollTimeout
+	}
+	out := link.drain(req.Context(), wait)
+	w.Header().Set(httpSessionHeader, id)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(encodeHTTPBody(out))
+}
+
+// session returns the link of id, and whether it's opened by this request.
+// A new session is opened by a request whose first packet is decrypted, otherwise it returns nil.
+func (s *httpServer) session(id string, req *http.Request, packets [][]byte, err error) (*pollLink, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if link, ok := s.sessions[id]; ok {
+		return link, false
+	}
+	if err != nil || len(packets) == 0 {
+		return nil, false
+	}
+	_, err = s.config.cipher.Decrypt(append([]byte(nil), packets[0]...))
+	if err != nil {
+		return nil, false
+	}
+	link := newPollLink(s.vpn.Context(), s.config, s.kind, "session:"+id[:8], req.RemoteAddr, nil)
+	s.sessions[id] = link
+	s.vpn.Go(func() {
+		tick := time.NewTicker(httpSessionTimeout / 3)
+		defer tick.Stop()
+		for {
+			select {
+			case <-link.Done():
+			case <-tick.C:
+				idle := time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&link.lastSeen))
+				if idle < httpSessionTimeout {
+					continue
+				}
+				log.Printf("%v expired", link.ToString(nil))
+				link.Cancel()
+			}
+			s.lock.Lock()
+			delete(s.sessions, id)
+			s.lock.Unlock()
+			return
+		}
+	})
+	s.vpn.AddLink(link)
+	return link, true
+}
+
+func newHTTP(vpn cutevpn.VPN, linkURL *url.URL, cipher cutevpn.Cipher) error {
+	config, err := parseHTTPConfig(linkURL, cipher)
+	if err != nil {
+		return err
+	}
+	if linkURL.Hostname() == "" {
+		return newHTTPListener(vpn, linkURL, config)
+	}
+	return newHTTPDialer(vpn, linkURL, config)
+}
+
+func newHTTPListener(vpn cutevpn.VPN, linkURL *url.URL, config streamConfig) error {
+	listener, err := net.Listen("tcp", linkURL.Host)
+	if err != nil {
+		return err
+	}
+	query := linkURL.Query()
+	if linkURL.Scheme == "https" {
+		if query.Get("cert") == "" || query.Get("key") == "" {
+			listener.Close()
+			return fmt.Errorf("an https listener needs cert and key")
+		}
+		creds, err := loadCredentials(vpn, query.Get("cert"), query.Get("key"), "")
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		listener = tls.NewListener(listener, creds.serverConfig(&tls.Config{
+			MinVersion: tls.VersionTLS12,
+		}))
+	}
+	fallback, err := newFallbackHandler(query.Get("fallback"))
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	path := linkURL.Path
+	if path == "" {
+		path = "/"
+	}
+	server := &http.Server{Handler: newHTTPServer(vpn, path, config, linkURL.Scheme, fallback)}
+	vpn.OnCancel(vpn.Context(), func() {
+		server.Close()
+	})
+	vpn.Go(func() {
+		err := server.Serve(listener)
+		if err != http.ErrServerClosed {
+			log.Println(err)
+		}
+	})
+	return nil
+}
+
+func newHTTPDialer(vpn cutevpn.VPN, linkURL *url.URL, config streamConfig) error {
+	transport := &http.Transport{}
+	if proxyAddr := linkURL.Query().Get("proxy"); proxyAddr != "" {
+		proxyURL, err := url.Parse(proxyAddr)
+		if err != nil {
+			return err
+		}
+		if proxyURL.Scheme == "http" {
+			// Plain HTTP requests are forwarded by the proxy, which works with proxies that block CONNECT.
+			transport.Proxy = http.ProxyURL(proxyURL)
+		}
+	}
+	if transport.Proxy == nil {
+		dial, err := newDialer(linkURL)
+		if err != nil {
+			return err
+		}
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dial(ctx, addr)
+		}
+	}
+	var creds *credentials
+	if linkURL.Scheme == "https" {
+		var err error
+		creds, err = loadCredentials(vpn, "", "", linkURL.Query().Get("cacert"))
+		if err != nil {
+			return err
+		}
+	}
+	// The query string holds the secret, don't send it to the server.
+	location := *linkURL
+	location.RawQuery = ""
+	vpn.Loop(func(ctx context.Context) error {
+		return connect(ctx, vpn, func(ctx context.Context) (cutevpn.Link, error) {
+			t := transport.Clone()
+			if creds != nil {
+				t.TLSClientConfig = creds.clientConfig(&tls.Config{
+					MinVersion: tls.VersionTLS12,
+					ServerName: linkURL.Hostname(),
+				})
+			}
+			return dialHTTP(ctx, vpn, &http.Client{Transport: t}, location.String(), config, linkURL.Scheme, linkURL.Host)
+		})
+	})
+	return nil
+}
+
+// httpClient is the dialer end of an HTTP session.
+type httpClient struct {
+	*pollLink
+	client   *http.Client
+	location string
+	id       string
+	failures int32
+}
+
+// dialHTTP opens a session, and starts the poll and the send loops.
+func dialHTTP(ctx context.Context, vpn cutevpn.VPN, client *http.Client, location string, config streamConfig, kind, host string) (cutevpn.Link, error) {
+	var id [16]byte
+	_, err := rand.Read(id[:])
+	if err != nil {
+		return nil, err
+	}
+	c := &httpClient{
+		client:   client,
+		location: location,
+		id:       hex.EncodeToString(id[:]),
+	}
+	c.pollLink = newPollLink(ctx, config, kind, "session:"+c.id[:8], host, host)
+	err = c.post([][]byte{openingPacket(c.cipher)})
+	if err != nil {
+		c.cancel()
+		client.CloseIdleConnections()
+		return nil, err
+	}
+	vpn.OnCancel(c.ctx, client.CloseIdleConnections)
+	vpn.Go(func() {
+		for c.ctx.Err() == nil {
+			c.retry(c.post(nil))
+		}
+	})
+	vpn.Go(func() {
+		for {
+			packets := c.drain(c.ctx, -1)
+			if packets == nil {
+				return
+			}
+			c.retry(c.post(packets))
+		}
+	})
+	return c, nil
+}
+
+// post sends packets, and receives the packets in the response.
+func (c *httpClient) post(packets [][]byte) error {
+	ctx, cancel := context.WithTimeout(c.ctx, httpPollTimeout+10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.location, bytes.NewReader(encodeHTTPBody(packets)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(httpSessionHeader, c.id)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v: %v", c.ToString(nil), resp.Status)
+	}
+	if resp.Header.Get(httpSessionHeader) != c.id {
+		// The server doesn't know the session, it may be restarted.
+		c.cancel()
+		return fmt.Errorf("%v: the session is lost", c.ToString(nil))
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, httpMaxBody))
+	if err != nil {
+		return err
+	}
+	received, err := decodeHTTPBody(body)
+	if err != nil {
+		return err
+	}
+	c.receive(ctx, received)
+	return nil
+}
+
+// retry counts the failed requests, and closes the session after httpMaxFailures.
+func (c *httpClient) retry(err error) {
+	if err == nil {
+		atomic.StoreInt32(&c.failures, 0)
+		return
+	}
+	if c.ctx.Err() != nil {
+		return
+	}
+	log.Println(err)
+	if atomic.AddInt32(&c.failures, 1) >= httpMaxFailures {
+		c.cancel()
+		return
+	}
+	select {
+	case <-time.After(time.Second):
+	case <-c.ctx.Done():
+	}
+}
@@ -0,0 +1,104 @@
+package link
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/clmul/cutevpn"
+	"github.com/clmul/cutevpn/encryption"
+)
+
+func TestHTTPBody(t *testing.T) {
+	packets := [][]byte{randomPacket(0), randomPacket(1), randomPacket(1500)}
+	decoded, err := decodeHTTPBody(encodeHTTPBody(packets))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(packets) {
+		t.Fatalf("%v packets are decoded", len(decoded))
+	}
+	for i := range packets {
+		if !bytes.Equal(decoded[i], packets[i]) {
+			t.Fatalf("packet %v is changed", i)
+		}
+	}
+	_, err = decodeHTTPBody([]byte{0, 5, 1})
+	if err == nil {
+		t.Fatal("a truncated body is decoded")
+	}
+}
+
+func TestHTTPSession(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cipher, err := encryption.NewAESGCM("255a5b9021450fe59c4712f0e19c9607")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := streamConfig{cipher: cipher, queue: httpDefaultQueue}
+	fallback, _ := newFallbackHandler("")
+
+	serverVPN := newTestVPN(ctx)
+	ts := httptest.NewServer(newHTTPServer(serverVPN, "/poll", config, "http", fallback))
+	defer ts.Close()
+
+	// Other requests are served by the fallback.
+	resp, err := http.Post(ts.URL+"/poll", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get(httpSessionHeader) != "" {
+		t.Fatal("a request without a session is served")
+	}
+
+	clientVPN := newTestVPN(ctx)
+	client, err := dialHTTP(ctx, clientVPN, &http.Client{}, ts.URL+"/poll", config, "http", "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var server cutevpn.Link
+	select {
+	case server = <-serverVPN.links:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session isn't opened")
+	}
+
+	for i := 0; i < 10; i++ {
+		up, down := randomPacket(1000), randomPacket(1000)
+		client.Send(append([]byte(nil), up...), nil)
+		if !bytes.Equal(recvPacket(t, server), up) {
+			t.Fatal("the packet to the server is changed")
+		}
+		// It's sent in the response of the held poll request.
+		server.Send(append([]byte(nil), down...), nil)
+		if !bytes.Equal(recvPacket(t, client), down) {
+			t.Fatal("the packet to the client is changed")
+		}
+	}
+
+	// A broken body of the session is rejected.
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/poll", bytes.NewReader([]byte{0, 5, 1}))
+	req.Header.Set(httpSessionHeader, client.(*httpClient).id)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || server.Stats().Load().DecryptErrors != 1 {
+		t.Fatalf("a broken body is answered with %v", resp.Status)
+	}
+
+	// The client closes the session when the server forgets it.
+	server.Cancel()
+	select {
+	case <-client.Done():
+	case <-time.After(2 * httpPollTimeout):
+		t.Fatal("the client keeps a lost session")
+	}
+}
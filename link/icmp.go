@@ -0,0 +1,283 @@
+package link
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/clmul/cutevpn"
+)
+
+const (
+	icmpEchoReply   = 0
+	icmpEchoRequest = 8
+
+	icmpHeaderLen = 8
+)
+
+// Every tunneled packet starts with icmpMagic and a direction,
+// so other ICMP packets and the echo replies generated by the kernel are ignored.
+const (
+	icmpMagic     = 0xc7
+	icmpDirDialer = 'q'
+	icmpDirListen = 'r'
+
+	icmpTunnelHeaderLen = 2
+)
+
+// icmpSocket is the raw socket shared by all icmp links.
+// It dispatches echo requests to the listener and echo replies to the dialers.
+type icmpSocket struct {
+	conn *net.IPConn
+
+	sync.Mutex
+	listener *icmp
+	dialers  map[cutevpn.IPv4]*icmp
+	// the identifier and sequence number of the latest echo request of each dialer
+	echoes map[cutevpn.IPv4]uint32
+}
+
+var icmpSingleton *icmpSocket
+
+// icmp carries packets in ICMP echo requests and replies.
+// The dialer sends echo requests and the listener answers with echo replies,
+// so the link passes through firewalls and NATs which only allow ping.
+type icmp struct {
+	sock   *icmpSocket
+	cipher cutevpn.Cipher
+	peer   cutevpn.LinkAddr
+	stats  *cutevpn.LinkStats
+	alive  *keepalive
+	in     chan icmpPacket
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// the identifier and sequence number of a dialer's echo requests,
+	// seq is accessed atomically because the keepalive sends too
+	id  uint16
+	seq uint32
+}
+
+type icmpPacket struct {
+	payload []byte
+	src     cutevpn.IPv4
+}
+
+func newICMP(vpn cutevpn.VPN, linkURL *url.URL, cipher cutevpn.Cipher) error {
+	timeout, err := parseKeepalive(linkURL)
+	if err != nil {
+		return err
+	}
+	if icmpSingleton == nil {
+		conn, err := net.ListenPacket("ip4:icmp", "")
+		if err != nil {
+			return err
+		}
+		icmpSingleton = &icmpSocket{
+			conn:    conn.(*net.IPConn),
+			dialers: make(map[cutevpn.IPv4]*icmp),
+			echoes:  make(map[cutevpn.IPv4]uint32),
+		}
+		vpn.OnCancel(vpn.Context(), func() {
+			err := conn.Close()
+			if err != nil {
+				log.Println(err)
+			}
+		})
+		vpn.Loop(icmpSingleton.dispatch)
+	}
+	if linkURL.Hostname() == "" {
+		_, err := startICMP(vpn, icmpSingleton, nil, cipher, timeout)
+		return err
+	}
+	resolve := func(host string) (cutevpn.LinkAddr, error) {
+		return resolveIPv4(host)
+	}
+	peer, err := resolve(linkURL.Hostname())
+	if err != nil {
+		return err
+	}
+	link, err := startICMP(vpn, icmpSingleton, peer, cipher, timeout)
+	if err != nil {
+		return err
+	}
+	// A dialer is closed by its keepalive when the listener is silent, and it's replaced here.
+	return watchPeer(vpn, linkURL, link, resolve, func(peer cutevpn.LinkAddr) (cutevpn.Link, error) {
+		return startICMP(vpn, icmpSingleton, peer, cipher, timeout)
+	})
+}
+
+// startICMP starts the listener if peer is nil, or a dialer to peer.
+func startICMP(vpn cutevpn.VPN, sock *icmpSocket, peer cutevpn.LinkAddr, cipher cutevpn.Cipher, timeout time.Duration) (*icmp, error) {
+	ctx, cancel := context.WithCancel(vpn.Context())
+	link := &icmp{
+		sock:   sock,
+		cipher: cipher,
+		peer:   peer,
+		stats:  new(cutevpn.LinkStats),
+		alive:  newKeepalive(timeout),
+		in:     make(chan icmpPacket, 16),
+		ctx:    ctx,
+		cancel: cancel,
+		id:     uint16(rand.Uint32()),
+	}
+	sock.Lock()
+	if peer == nil {
+		if sock.listener != nil {
+			sock.Unlock()
+			cancel()
+			return nil, errors.New("there can be only one icmp listener")
+		}
+		sock.listener = link
+	} else {
+		sock.dialers[peer.(cutevpn.IPv4)] = link
+	}
+	sock.Unlock()
+	vpn.OnCancel(ctx, func() {
+		sock.Lock()
+		if peer == nil {
+			sock.listener = nil
+		} else if sock.dialers[peer.(cutevpn.IPv4)] == link {
+			delete(sock.dialers, peer.(cutevpn.IPv4))
+		}
+		sock.Unlock()
+	})
+	vpn.AddLink(link)
+	if peer != nil {
+		link.alive.start(vpn, link)
+	}
+	return link, nil
+}
+
+func (s *icmpSocket) dispatch(ctx context.Context) error {
+	buffer := make([]byte, 2048)
+	n, ipAddr, err := s.conn.ReadFromIP(buffer)
+	if err != nil {
+		return err
+	}
+	packet := buffer[:n]
+	if len(packet) < icmpHeaderLen+icmpTunnelHeaderLen || packet[icmpHeaderLen] != icmpMagic {
+		return nil
+	}
+	typ, dir := packet[0], packet[icmpHeaderLen+1]
+	src := convertIPAddr(ipAddr)
+	p := icmpPacket{payload: packet[icmpHeaderLen+icmpTunnelHeaderLen:], src: src}
+
+	var link *icmp
+	s.Lock()
+	switch {
+	case typ == icmpEchoRequest && dir == icmpDirDialer:
+		link = s.listener
+		s.echoes[src] = binary.BigEndian.Uint32(packet[4:8])
+	case typ == icmpEchoReply && dir == icmpDirListen:
+		link = s.dialers[src]
+	}
+	s.Unlock()
+	if link == nil {
+		return nil
+	}
+	select {
+	case link.in <- p:
+	default:
+		link.stats.AddDropped()
+	}
+	return nil
+}
+
+func (t *icmp) ToString(dst cutevpn.LinkAddr) string {
+	if dst == nil {
+		dst = "any"
+	}
+	return fmt.Sprintf("icmp %v->%v", t.sock.conn.LocalAddr(), dst)
+}
+
+func (t *icmp) Peer() cutevpn.LinkAddr {
+	return t.peer
+}
+
+func (t *icmp) Send(packet []byte, addr cutevpn.LinkAddr) error {
+	dst := addr.(cutevpn.IPv4)
+	packet = encryptTo(t.cipher, packet, dst)
+	msg := make([]byte, icmpHeaderLen+icmpTunnelHeaderLen, icmpHeaderLen+icmpTunnelHeaderLen+len(packet))
+	if t.peer != nil {
+		msg[0] = icmpEchoRequest
+		binary.BigEndian.PutUint16(msg[4:], t.id)
+		binary.BigEndian.PutUint16(msg[6:], uint16(atomic.AddUint32(&t.seq, 1)))
+		msg[icmpHeaderLen+1] = icmpDirDialer
+	} else {
+		// Answer the latest request of the dialer, so that NATs let the reply in.
+		t.sock.Lock()
+		echo, ok := t.sock.echoes[dst]
+		t.sock.Unlock()
+		if !ok {
+			t.stats.AddDropped()
+			return nil
+		}
+		msg[0] = icmpEchoReply
+		binary.BigEndian.PutUint32(msg[4:], echo)
+		msg[icmpHeaderLen+1] = icmpDirListen
+	}
+	msg[icmpHeaderLen] = icmpMagic
+	msg = append(msg, packet...)
+	binary.BigEndian.PutUint16(msg[2:], icmpChecksum(msg))
+	_, err := t.sock.conn.WriteToIP(msg, convertToIPAddr(dst))
+	return err
+}
+
+func (t *icmp) Recv(buffer []byte) ([]byte, cutevpn.LinkAddr, error) {
+	select {
+	case <-t.ctx.Done():
+		return nil, nil, t.ctx.Err()
+	case p := <-t.in:
+		n := copy(buffer, p.payload)
+		packet, err := decryptFrom(t.cipher, buffer[:n], p.src)
+		if err != nil {
+			t.stats.AddDecryptError()
+			log.Println(err)
+			return buffer[:0], nil, nil
+		}
+		if t.alive.received(packet, func(packet []byte) error { return t.Send(packet, p.src) }) {
+			return buffer[:0], nil, nil
+		}
+		return packet, p.src, nil
+	}
+}
+
+func (t *icmp) Overhead() int {
+	return 20 + icmpHeaderLen + icmpTunnelHeaderLen + t.cipher.Overhead()
+}
+
+func (t *icmp) Cancel() {
+	t.cancel()
+}
+
+func (t *icmp) Done() <-chan struct{} {
+	return t.ctx.Done()
+}
+
+func (t *icmp) Stats() *cutevpn.LinkStats {
+	return t.stats
+}
+
+// icmpChecksum is the Internet checksum of msg, whose checksum field is zero.
+func icmpChecksum(msg []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(msg); i += 2 {
+		sum += uint32(msg[i])<<8 | uint32(msg[i+1])
+	}
+	if len(msg)%2 == 1 {
+		sum += uint32(msg[len(msg)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -2,56 +2,185 @@ package link
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/url"
+	"strconv"
+	"sync"
 
 	"github.com/clmul/cutevpn"
 )
 
+// ipip sends packets in raw IP packets.
+// The outer header is IPv4 or IPv6, and the protocol number is 4(IPIP) or 47(GRE) by default.
+// The link address is cutevpn.IPv4 on IPv4 and AddrPort with port 0 on IPv6.
 type ipip struct {
-	*net.IPConn
+	*rawSocket
+	kind   string
+	ipv6   bool
+	gre    bool
 	cipher cutevpn.Cipher
 	peer   cutevpn.LinkAddr
+	stats  *cutevpn.LinkStats
+	alive  *keepalive
 	ctx    context.Context
 	cancel context.CancelFunc
 }
 
-var singleton *net.IPConn
+const (
+	protocolIPIP = 4
+	protocolGRE  = 47
+
+	greHeaderLen = 4
+	greProtoIPv4 = 0x0800
+)
+
+// rawSocket is shared by the links of the same network, like "ip4:4".
+// It's read by one loop, and any of the links which aren't canceled may
+// receive a packet, so the keepalives of the links are found by the source address.
+type rawSocket struct {
+	*net.IPConn
+	in chan rawPacket
+
+	lock   sync.Mutex
+	alives map[cutevpn.LinkAddr]*keepalive
+}
+
+type rawPacket struct {
+	payload []byte
+	src     *net.IPAddr
+}
+
+var singletons = make(map[string]*rawSocket)
+
+func (s *rawSocket) keepalive(addr cutevpn.LinkAddr) *keepalive {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.alives[addr]
+}
+
+// watch registers the keepalive of a link with a peer and starts it.
+func (s *rawSocket) watch(vpn cutevpn.VPN, link *ipip) {
+	s.lock.Lock()
+	s.alives[link.peer] = link.alive
+	s.lock.Unlock()
+	vpn.OnCancel(link.ctx, func() {
+		s.lock.Lock()
+		if s.alives[link.peer] == link.alive {
+			delete(s.alives, link.peer)
+		}
+		s.lock.Unlock()
+	})
+	link.alive.start(vpn, link)
+}
+
+func (s *rawSocket) read(ctx context.Context) error {
+	buffer := make([]byte, 2048)
+	n, ipAddr, err := s.ReadFromIP(buffer)
+	if err != nil {
+		return err
+	}
+	select {
+	case s.in <- rawPacket{payload: buffer[:n], src: ipAddr}:
+	case <-ctx.Done():
+	}
+	return nil
+}
 
 func newIPIP(vpn cutevpn.VPN, linkURL *url.URL, cipher cutevpn.Cipher) error {
 	ctx, cancel := context.WithCancel(vpn.Context())
 	link := &ipip{
+		kind:   linkURL.Scheme,
 		ctx:    ctx,
 		cancel: cancel,
 		cipher: cipher,
+		stats:  new(cutevpn.LinkStats),
+	}
+	protocol := protocolIPIP
+	switch linkURL.Scheme {
+	case "ipip":
+	case "ipip6":
+		link.ipv6 = true
+	case "gre":
+		link.gre = true
+		protocol = protocolGRE
+	case "gre6":
+		link.ipv6 = true
+		link.gre = true
+		protocol = protocolGRE
+	}
+	timeout, err := parseKeepalive(linkURL)
+	if err != nil {
+		cancel()
+		return err
+	}
+	link.alive = newKeepalive(timeout)
+	if proto := linkURL.Query().Get("proto"); proto != "" {
+		protocol, err = strconv.Atoi(proto)
+		if err != nil || protocol <= 0 || protocol > 255 {
+			cancel()
+			return fmt.Errorf("%v is not a valid IP protocol number", proto)
+		}
 	}
-	var err error
-
 	if linkURL.Hostname() != "" {
-		link.peer, err = resolveIPv4(linkURL.Hostname())
+		link.peer, err = link.resolve(linkURL.Hostname())
 		if err != nil {
+			cancel()
 			return err
 		}
 	}
 
-	if singleton == nil {
-		conn, err := net.ListenPacket("ip4:4", "")
+	network := fmt.Sprintf("ip4:%v", protocol)
+	if link.ipv6 {
+		network = fmt.Sprintf("ip6:%v", protocol)
+	}
+	singleton, ok := singletons[network]
+	if !ok {
+		conn, err := net.ListenPacket(network, "")
 		if err != nil {
+			cancel()
 			return err
 		}
-		singleton = conn.(*net.IPConn)
+		singleton = &rawSocket{
+			IPConn: conn.(*net.IPConn),
+			in:     make(chan rawPacket, 16),
+			alives: make(map[cutevpn.LinkAddr]*keepalive),
+		}
+		singletons[network] = singleton
 		vpn.OnCancel(vpn.Context(), func() {
 			err := conn.Close()
 			if err != nil {
 				log.Println(err)
 			}
 		})
+		vpn.Loop(singleton.read)
 	}
-	link.IPConn = singleton
+	link.rawSocket = singleton
 	vpn.AddLink(link)
-	return nil
+	if link.peer == nil {
+		return nil
+	}
+	singleton.watch(vpn, link)
+	return watchPeer(vpn, linkURL, link, link.resolve, func(peer cutevpn.LinkAddr) (cutevpn.Link, error) {
+		return link.relink(vpn, peer), nil
+	})
+}
+
+// relink starts a link like t to peer, which replaces t.
+func (t *ipip) relink(vpn cutevpn.VPN, peer cutevpn.LinkAddr) *ipip {
+	ctx, cancel := context.WithCancel(vpn.Context())
+	next := *t
+	next.peer = peer
+	next.stats = new(cutevpn.LinkStats)
+	next.alive = newKeepalive(t.alive.timeout)
+	next.ctx = ctx
+	next.cancel = cancel
+	vpn.AddLink(&next)
+	t.watch(vpn, &next)
+	return &next
 }
 
 func convertIPAddr(addr *net.IPAddr) (a cutevpn.IPv4) {
@@ -64,7 +193,7 @@ func convertToIPAddr(a cutevpn.IPv4) *net.IPAddr {
 }
 
 func (t *ipip) ToString(dst cutevpn.LinkAddr) string {
-	return fmt.Sprintf("ipip %v->%v", t.IPConn.LocalAddr(), dst)
+	return fmt.Sprintf("%v %v->%v", t.kind, t.IPConn.LocalAddr(), dst)
 }
 
 func resolveIPv4(addr string) (cutevpn.IPv4, error) {
@@ -75,32 +204,87 @@ func resolveIPv4(addr string) (cutevpn.IPv4, error) {
 	return convertIPAddr(ipAddr), nil
 }
 
+// resolve returns the link address of host.
+func (t *ipip) resolve(host string) (cutevpn.LinkAddr, error) {
+	if !t.ipv6 {
+		return resolveIPv4(host)
+	}
+	ipAddr, err := net.ResolveIPAddr("ip6", host)
+	if err != nil {
+		return nil, err
+	}
+	return convertNetAddr(ipAddr.IP, 0), nil
+}
+
 func (t *ipip) Peer() cutevpn.LinkAddr {
 	return t.peer
 }
 
 func (t *ipip) Send(packet []byte, addr cutevpn.LinkAddr) error {
-	packet = t.cipher.Encrypt(packet)
-	_, err := t.WriteToIP(packet, convertToIPAddr(addr.(cutevpn.IPv4)))
+	packet = encryptTo(t.cipher, packet, addr)
+	if t.gre {
+		var header [greHeaderLen]byte
+		binary.BigEndian.PutUint16(header[2:], greProtoIPv4)
+		packet = append(header[:], packet...)
+	}
+	var dst *net.IPAddr
+	if t.ipv6 {
+		ip, _ := convertToNetAddr(addr.(AddrPort))
+		dst = &net.IPAddr{IP: ip}
+	} else {
+		dst = convertToIPAddr(addr.(cutevpn.IPv4))
+	}
+	_, err := t.WriteToIP(packet, dst)
 	return err
 }
 
-func (t *ipip) Recv(packet []byte) ([]byte, cutevpn.LinkAddr, error) {
-	n, ipAddr, err := t.ReadFromIP(packet)
-	if err != nil {
-		return nil, nil, err
+func (t *ipip) Recv(buffer []byte) ([]byte, cutevpn.LinkAddr, error) {
+	var p rawPacket
+	select {
+	case <-t.ctx.Done():
+		return nil, nil, t.ctx.Err()
+	case p = <-t.in:
+	}
+	packet := buffer[:copy(buffer, p.payload)]
+	ipAddr := p.src
+	if t.gre {
+		if len(packet) < greHeaderLen || binary.BigEndian.Uint16(packet) != 0 {
+			log.Println(errGREHeader)
+			return packet[:0], nil, nil
+		}
+		packet = packet[greHeaderLen:]
 	}
-	packet = packet[:n]
-	packet, err = t.cipher.Decrypt(packet)
+	var addr cutevpn.LinkAddr
+	if t.ipv6 {
+		addr = convertNetAddr(ipAddr.IP, 0)
+	} else {
+		addr = convertIPAddr(ipAddr)
+	}
+	packet, err := decryptFrom(t.cipher, packet, addr)
 	if err != nil {
+		t.stats.AddDecryptError()
 		log.Println(err)
 		return packet[:0], nil, nil
 	}
-	return packet, convertIPAddr(ipAddr), nil
+	alive := t.keepalive(addr)
+	if alive == nil {
+		alive = t.alive
+	}
+	if alive.received(packet, func(p []byte) error { return t.Send(p, addr) }) {
+		return packet[:0], nil, nil
+	}
+	return packet, addr, nil
 }
 
 func (t *ipip) Overhead() int {
-	return 20 + t.cipher.Overhead()
+	overhead := 20 + t.cipher.Overhead()
+	if t.ipv6 {
+		overhead += 20
+	}
+	if t.gre {
+		overhead += greHeaderLen
+	}
+	return overhead
 }
 
 func (t *ipip) Cancel() {
@@ -111,4 +295,10 @@ func (t *ipip) Done() <-chan struct{} {
 	return t.ctx.Done()
 }
 
+func (t *ipip) Stats() *cutevpn.LinkStats {
+	return t.stats
+}
+
+var errGREHeader = errors.New("unsupported GRE header")
+
 var emptyIPv4 cutevpn.IPv4
@@ -0,0 +1,127 @@
+package link
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/clmul/cutevpn"
+)
+
+// newLoopbackIPIP creates an ipip link of rawURL whose peer is itself.
+// The test is skipped without the permission of raw sockets.
+func newLoopbackIPIP(t *testing.T, ctx context.Context, rawURL, network string) *ipip {
+	vpn := newTestVPN(ctx)
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = New(vpn, u)
+	if errors.Is(err, os.ErrPermission) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The socket is closed with ctx, so the next test opens its own.
+	t.Cleanup(func() { delete(singletons, network) })
+	return waitLink(t, vpn).(*ipip)
+}
+
+// testLoopbackIPIP sends packets to the link itself.
+func testLoopbackIPIP(t *testing.T, link *ipip) {
+	for i := 0; i < 10; i++ {
+		p := randomPacket(1000)
+		err := link.Send(append([]byte(nil), p...), link.Peer())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(recvPacket(t, link), p) {
+			t.Fatal("the packet is changed")
+		}
+	}
+}
+
+func TestGRE(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	link := newLoopbackIPIP(t, ctx, "gre://127.0.0.1/?secret=41fa34cd493a5955e185b36abb117a6f", "ip4:47")
+	if link.Peer() != (cutevpn.IPv4{127, 0, 0, 1}) {
+		t.Fatalf("the peer is %v", link.Peer())
+	}
+	testLoopbackIPIP(t, link)
+
+	// GRE packets with options and packets of other secrets are dropped.
+	buffer := make([]byte, 2048)
+	for _, p := range [][]byte{
+		append([]byte{0x80, 0, 8, 0}, randomPacket(100)...),
+		append([]byte{0, 0, 8, 0}, randomPacket(100)...),
+	} {
+		_, err := link.WriteToIP(p, convertToIPAddr(cutevpn.IPv4{127, 0, 0, 1}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, _, err := link.Recv(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(p) != 0 {
+			t.Fatal("a broken packet is received")
+		}
+	}
+	if link.Stats().Load().DecryptErrors != 1 {
+		t.Fatalf("%v decrypt errors are counted", link.Stats().Load().DecryptErrors)
+	}
+}
+
+func TestIPIP6(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	link := newLoopbackIPIP(t, ctx, "ipip6://[::1]/?secret=41fa34cd493a5955e185b36abb117a6f", "ip6:4")
+	if link.Peer() != convertNetAddr(net.IPv6loopback, 0) {
+		t.Fatalf("the peer is %v", link.Peer())
+	}
+	if link.Overhead() != 40+link.cipher.Overhead() {
+		t.Fatalf("the overhead is %v", link.Overhead())
+	}
+	testLoopbackIPIP(t, link)
+}
+
+func TestIPIPRelink(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	link := newLoopbackIPIP(t, ctx, "ipip://127.0.0.1/?secret=41fa34cd493a5955e185b36abb117a6f", "ip4:4")
+	next := link.relink(newTestVPN(ctx), link.Peer())
+	link.Cancel()
+
+	// The replaced link stops receiving, so it doesn't take the packets of the new link.
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := link.Recv(make([]byte, 2048))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("a canceled link receives a packet")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a canceled link keeps receiving")
+	}
+	testLoopbackIPIP(t, next)
+}
+
+func TestIPIPProto(t *testing.T) {
+	for _, s := range []string{"ipip://127.0.0.1/?proto=0", "ipip://127.0.0.1/?proto=256", "ipip://127.0.0.1/?proto=gre"} {
+		u, _ := url.Parse(s)
+		err := New(newTestVPN(context.Background()), u)
+		if err == nil {
+			t.Fatalf("%v is accepted", s)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package link
+
+import (
+	"bytes"
+	"log"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/clmul/cutevpn"
+)
+
+// The default time after which a datagram link is closed if its peer is silent.
+const defaultKeepaliveTimeout = 15 * time.Second
+
+// The keepalive messages are signals, see signalSize.
+var (
+	keepaliveRequest = []byte("cutevpnk?")
+	keepaliveReply   = []byte("cutevpnk!")
+)
+
+// keepalive detects the dead peer of a datagram link.
+// The link sends keepalive requests when it receives nothing for a while,
+// and it's canceled if the peer is silent longer than timeout.
+//
+// The requests are sent by the goroutine of start, and the replies by Recv,
+// not by the main loop, so the Send of a link with a keepalive must be safe
+// for concurrent use. The udp, ipip and icmp links have no state for sending
+// which isn't locked or atomic.
+type keepalive struct {
+	timeout time.Duration
+	// time.Now().UnixNano() when the last packet is received, accessed atomically
+	lastRecv int64
+}
+
+func parseKeepalive(linkURL *url.URL) (time.Duration, error) {
+	s := linkURL.Query().Get("keepalive")
+	if s == "" {
+		return defaultKeepaliveTimeout, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func newKeepalive(timeout time.Duration) *keepalive {
+	return &keepalive{
+		timeout:  timeout,
+		lastRecv: time.Now().UnixNano(),
+	}
+}
+
+// start watches link until it's done. It does nothing if the timeout is 0.
+func (k *keepalive) start(vpn cutevpn.VPN, link cutevpn.Link) {
+	if k.timeout <= 0 {
+		return
+	}
+	vpn.Go(func() {
+		tick := time.NewTicker(k.timeout / 3)
+		defer tick.Stop()
+		for {
+			select {
+			case <-link.Done():
+				return
+			case <-tick.C:
+			}
+			silence := time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&k.lastRecv))
+			if silence > k.timeout {
+				log.Printf("%v is silent for %v", link.ToString(link.Peer()), silence)
+				link.Cancel()
+				return
+			}
+			if silence > k.timeout/3 {
+				err := link.Send(append([]byte(nil), keepaliveRequest...), link.Peer())
+				if err != nil {
+					log.Println(err)
+				}
+			}
+		}
+	})
+}
+
+// received is called with every packet the link receives. It returns true if
+// packet is a keepalive message, which should be dropped by the link.
+// A keepalive request is answered by send.
+//
+// An empty packet doesn't show that the peer is alive, because it may be
+// unauthenticated, like the empty messages of noise. It's dropped too.
+func (k *keepalive) received(packet []byte, send func(packet []byte) error) bool {
+	if len(packet) == 0 {
+		return true
+	}
+	atomic.StoreInt64(&k.lastRecv, time.Now().UnixNano())
+	switch {
+	case bytes.Equal(packet, keepaliveRequest):
+		err := send(append([]byte(nil), keepaliveReply...))
+		if err != nil {
+			log.Println(err)
+		}
+		return true
+	case bytes.Equal(packet, keepaliveReply):
+		return true
+	}
+	return false
+}
@@ -0,0 +1,201 @@
+package link
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/clmul/cutevpn"
+)
+
+// sendLink is a peerLink whose sent packets are in sent.
+type sendLink struct {
+	*peerLink
+	sent chan []byte
+}
+
+func (l *sendLink) Send(packet []byte, dst cutevpn.LinkAddr) error {
+	l.sent <- packet
+	return nil
+}
+
+func TestKeepaliveMessages(t *testing.T) {
+	if len(keepaliveRequest) != signalSize || len(keepaliveReply) != signalSize {
+		t.Fatal("the keepalive messages aren't signals")
+	}
+	k := newKeepalive(time.Second)
+	var sent [][]byte
+	send := func(p []byte) error {
+		sent = append(sent, p)
+		return nil
+	}
+	if !k.received(append([]byte(nil), keepaliveRequest...), send) {
+		t.Fatal("a keepalive request isn't dropped")
+	}
+	if len(sent) != 1 || !bytes.Equal(sent[0], keepaliveReply) {
+		t.Fatal("a keepalive request isn't answered")
+	}
+	if !k.received(append([]byte(nil), keepaliveReply...), send) {
+		t.Fatal("a keepalive reply isn't dropped")
+	}
+	if k.received(randomPacket(100), send) || k.received(randomPacket(signalSize), send) {
+		t.Fatal("a packet is dropped")
+	}
+	if len(sent) != 1 {
+		t.Fatal("a keepalive reply is answered")
+	}
+
+	// Empty packets, like the unauthenticated empty messages of noise, don't refresh the link.
+	atomic.StoreInt64(&k.lastRecv, 0)
+	if !k.received(nil, send) || atomic.LoadInt64(&k.lastRecv) != 0 {
+		t.Fatal("an empty packet refreshes the link")
+	}
+}
+
+func TestKeepaliveTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	vpn := newTestVPN(ctx)
+	link := &sendLink{peerLink: newPeerLink(ctx, "server"), sent: make(chan []byte, 16)}
+	const timeout = 300 * time.Millisecond
+	k := newKeepalive(timeout)
+	start := time.Now()
+	k.start(vpn, link)
+
+	// The link is kept while packets are received.
+	var last time.Time
+	for time.Since(start) < 3*timeout {
+		k.received(randomPacket(100), nil)
+		last = time.Now()
+		time.Sleep(timeout / 10)
+	}
+	select {
+	case <-link.Done():
+		t.Fatal("a link which receives packets is canceled")
+	default:
+	}
+
+	// A silent link sends keepalive requests, and it's canceled after timeout.
+	select {
+	case p := <-link.sent:
+		if !bytes.Equal(p, keepaliveRequest) {
+			t.Fatal("a keepalive request is changed")
+		}
+	case <-time.After(timeout):
+		t.Fatal("no keepalive request is sent")
+	}
+	select {
+	case <-link.Done():
+	case <-time.After(2 * timeout):
+		t.Fatal("a silent link isn't canceled")
+	}
+	if time.Since(last) < timeout {
+		t.Fatal("a link is canceled before timeout")
+	}
+
+	// keepalive=0 doesn't watch the link.
+	link = &sendLink{peerLink: newPeerLink(ctx, "server"), sent: make(chan []byte, 16)}
+	newKeepalive(0).start(vpn, link)
+	select {
+	case <-link.sent:
+		t.Fatal("a keepalive request is sent with keepalive=0")
+	case <-time.After(timeout):
+	}
+}
+
+// serveUDP starts a udp listener on port, which receives packets until ctx is canceled.
+// The packets are sent to the returned channel.
+func serveUDP(t *testing.T, ctx context.Context, port int) <-chan []byte {
+	vpn := newTestVPN(ctx)
+	newTestLink(t, vpn, fmt.Sprintf("udp://:%v/?secret=255a5b9021450fe59c4712f0e19c9607", port))
+	link := waitLink(t, vpn)
+	packets := make(chan []byte, 16)
+	go func() {
+		buffer := make([]byte, 2048)
+		for {
+			p, _, err := link.Recv(buffer)
+			if err != nil {
+				return
+			}
+			if len(p) > 0 {
+				packets <- append([]byte(nil), p...)
+			}
+		}
+	}()
+	return packets
+}
+
+func TestKeepaliveRelink(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.LocalAddr().(*net.UDPAddr).Port
+	l.Close()
+
+	serverCtx, stopServer := context.WithCancel(ctx)
+	packets := serveUDP(t, serverCtx, port)
+	clientVPN := newTestVPN(ctx)
+	u, _ := url.Parse(fmt.Sprintf("udp://127.0.0.1:%v/?secret=255a5b9021450fe59c4712f0e19c9607&keepalive=300ms", port))
+	err = New(clientVPN, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// roundTrip sends a packet by client, the returned channel is closed when its Recv fails.
+	roundTrip := func(client cutevpn.Link) <-chan struct{} {
+		closed := make(chan struct{})
+		go func() {
+			closeOnError(client)
+			close(closed)
+		}()
+		p := randomPacket(1000)
+		client.Send(append([]byte(nil), p...), client.Peer())
+		select {
+		case r := <-packets:
+			if !bytes.Equal(r, p) {
+				t.Fatal("the packet is changed")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the packet isn't received")
+		}
+		return closed
+	}
+	client := waitLink(t, clientVPN)
+	closed := roundTrip(client)
+
+	// The listener answers the keepalive requests.
+	time.Sleep(time.Second)
+	select {
+	case <-client.Done():
+		t.Fatal("the link to a live listener is canceled")
+	default:
+	}
+
+	// The link is canceled when the listener stops, and a new link is started.
+	stopServer()
+	select {
+	case <-client.Done():
+	case <-time.After(time.Second):
+		t.Fatal("the link to a stopped listener isn't canceled")
+	}
+	// The canceled link stops receiving, so it doesn't take the packets of the new link.
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("the canceled link keeps receiving")
+	}
+	packets = serveUDP(t, ctx, port)
+	select {
+	case client = <-clientVPN.links:
+	case <-time.After(relinkDelay + 2*time.Second):
+		t.Fatal("the link isn't started again")
+	}
+	roundTrip(client)
+}
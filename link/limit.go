@@ -0,0 +1,167 @@
+package link
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/clmul/cutevpn"
+)
+
+// Every link can have a rate limit, like rate=20m&burst=64k.
+// rate is in bits per second, and burst is the bytes which can be sent at once.
+// The packets over the limit are dropped and counted in LinkStats.Limited,
+// but the routing packets are always sent, see cutevpn.ControlSender.
+
+const (
+	// The default burst is the bytes sent at the rate in defaultBurstTime, at least minBurst.
+	defaultBurstTime = 100 * time.Millisecond
+	// A smaller burst would drop the largest packets.
+	minBurst = 2048
+)
+
+// tokenBucket limits the bytes sent by a Link.
+// It's used by the main loop and the routing, so it has a lock.
+type tokenBucket struct {
+	lock sync.Mutex
+	// bytes per second
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// take returns false if there aren't n tokens.
+func (b *tokenBucket) take(n int, now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill(now)
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// spend takes n tokens even if there aren't enough, the next packets wait for them.
+func (b *tokenBucket) spend(n int, now time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill(now)
+	b.tokens -= float64(n)
+}
+
+// saturated reports whether a packet of the max size would be dropped.
+func (b *tokenBucket) saturated(now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill(now)
+	return b.tokens < minBurst
+}
+
+// limitedLink drops the packets over the rate limit of a Link.
+type limitedLink struct {
+	cutevpn.Link
+	bucket *tokenBucket
+}
+
+func (l *limitedLink) Send(packet []byte, dst cutevpn.LinkAddr) error {
+	if !l.bucket.take(len(packet), time.Now()) {
+		l.Stats().AddLimited()
+		return nil
+	}
+	return l.Link.Send(packet, dst)
+}
+
+func (l *limitedLink) SendControl(packet []byte, dst cutevpn.LinkAddr) error {
+	l.bucket.spend(len(packet), time.Now())
+	return l.Link.Send(packet, dst)
+}
+
+func (l *limitedLink) Saturated() bool {
+	return l.bucket.saturated(time.Now())
+}
+
+// limitedVPN adds the rate limit to every Link it adds,
+// so every session of a listener has its own limit.
+type limitedVPN struct {
+	cutevpn.VPN
+	rate  float64
+	burst float64
+}
+
+func (v *limitedVPN) AddLink(link cutevpn.Link) {
+	v.VPN.AddLink(&limitedLink{
+		Link:   link,
+		bucket: newTokenBucket(v.rate, v.burst),
+	})
+}
+
+// withRateLimit returns a VPN which adds the links with the rate limit of linkURL,
+// or vpn itself if linkURL has no limit.
+func withRateLimit(vpn cutevpn.VPN, linkURL *url.URL) (cutevpn.VPN, error) {
+	query := linkURL.Query()
+	if query.Get("rate") == "" {
+		if query.Get("burst") != "" {
+			return nil, fmt.Errorf("burst needs rate")
+		}
+		return vpn, nil
+	}
+	bits, err := parseSize(query.Get("rate"), 1000)
+	if err != nil || !(bits > 0) {
+		return nil, fmt.Errorf("%v is not a valid rate", query.Get("rate"))
+	}
+	rate := bits / 8
+	burst := rate * defaultBurstTime.Seconds()
+	if burst < minBurst {
+		burst = minBurst
+	}
+	if s := query.Get("burst"); s != "" {
+		burst, err = parseSize(s, 1024)
+		if err != nil || !(burst >= minBurst) {
+			return nil, fmt.Errorf("%v is not a valid burst, it's at least %v bytes", s, minBurst)
+		}
+	}
+	return &limitedVPN{VPN: vpn, rate: rate, burst: burst}, nil
+}
+
+// parseSize parses a number with an optional suffix k, m or g, which are powers of base.
+func parseSize(s string, base float64) (float64, error) {
+	mul := 1.0
+	switch strings.ToLower(s[len(s)-1:]) {
+	case "k":
+		mul = base
+	case "m":
+		mul = base * base
+	case "g":
+		mul = base * base * base
+	}
+	if mul != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * mul, nil
+}
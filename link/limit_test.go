@@ -0,0 +1,86 @@
+package link
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	// 8 Mbit/s is 1 MB/s.
+	b := newTokenBucket(1e6, 4096)
+	if !b.take(1500, start) || !b.take(1500, start) {
+		t.Fatal("the burst is dropped")
+	}
+	if !b.saturated(start) {
+		t.Fatal("the bucket isn't saturated after the burst")
+	}
+	if b.take(1500, start) {
+		t.Fatal("the packet over the burst is sent")
+	}
+	// 1500 bytes are refilled in 1.5ms.
+	now := start.Add(1500 * time.Microsecond)
+	if !b.take(1500, now) {
+		t.Fatal("the bucket isn't refilled")
+	}
+	now = now.Add(time.Second)
+	if b.saturated(now) {
+		t.Fatal("the bucket is saturated after a second")
+	}
+	for i := 0; i < 2; i++ {
+		if !b.take(2048, now) {
+			t.Fatal("the refilled burst is dropped")
+		}
+	}
+	if b.take(1, now) {
+		t.Fatal("the bucket holds more than the burst")
+	}
+}
+
+func TestLimitedLinkControl(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	inner := &sendLink{peerLink: newPeerLink(ctx, "peer"), sent: make(chan []byte, 16)}
+	link := &limitedLink{Link: inner, bucket: newTokenBucket(1000, minBurst)}
+	for i := 0; i < 2; i++ {
+		link.Send(randomPacket(1500), "peer")
+	}
+	// The routing packets are sent over the limit, and the next packets wait for their bytes.
+	for i := 0; i < 2; i++ {
+		link.SendControl(randomPacket(1000), "peer")
+	}
+	link.Send(randomPacket(100), "peer")
+	if len(inner.sent) != 3 {
+		t.Fatalf("%v packets are sent", len(inner.sent))
+	}
+	if n := link.Stats().Load().Limited; n != 2 {
+		t.Fatalf("%v packets are limited", n)
+	}
+}
+
+func TestRateLimitConfig(t *testing.T) {
+	for s, want := range map[string]limitedVPN{
+		"udp://:1/?rate=8m":            {rate: 1e6, burst: 1e5},
+		"udp://:1/?rate=80k":           {rate: 1e4, burst: minBurst},
+		"udp://:1/?rate=1.6g&burst=1m": {rate: 2e8, burst: 1 << 20},
+	} {
+		u, _ := url.Parse(s)
+		vpn, err := withRateLimit(nil, u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := vpn.(*limitedVPN)
+		if got.rate != want.rate || got.burst != want.burst {
+			t.Fatalf("%v is rate %v burst %v", s, got.rate, got.burst)
+		}
+	}
+	for _, s := range []string{"udp://:1/?rate=fast", "udp://:1/?rate=-1k", "udp://:1/?rate=1m&burst=1k", "udp://:1/?burst=64k"} {
+		u, _ := url.Parse(s)
+		_, err := withRateLimit(nil, u)
+		if err == nil {
+			t.Fatalf("%v is accepted", s)
+		}
+	}
+}
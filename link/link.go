@@ -1,48 +1,112 @@
 package link
 
 import (
-	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"net/url"
 	"os"
+	"strconv"
 
 	"github.com/clmul/cutevpn"
 	"github.com/clmul/cutevpn/encryption"
 )
 
+// signalSize is the size of the messages of the links themselves, like keepalives.
+// It's the size of the tail of a packet in vpn.conn, so vpn.conn reads a signal as
+// an empty packet and drops it, and the peers which don't know a signal ignore it.
+const signalSize = 9
+
 func New(vpn cutevpn.VPN, linkURL *url.URL) error {
+	vpn, err := withRateLimit(vpn, linkURL)
+	if err != nil {
+		return err
+	}
 	var cipher cutevpn.Cipher = encryption.Plain{}
-	if secret := linkURL.Query().Get("secret"); secret != "" {
-		var err error
-		cipher, err = encryption.NewAESGCM(secret)
-		if err != nil {
-			return err
+	var keys *keySet
+	query := linkURL.Query()
+	switch {
+	case query.Get("cipher") == "noise":
+		cipher, err = newNoiseCipher(linkURL)
+	case hasSecret(query):
+		cipher, keys, err = newSecretCipher(vpn, query)
+	case query.Get("cipher") != "":
+		err = fmt.Errorf("cipher needs secret")
+	case query.Get("kdf") != "":
+		err = fmt.Errorf("kdf needs secret")
+	}
+	if err != nil {
+		return err
+	}
+	if needsSecret(linkURL) && !hasSecret(query) {
+		return fmt.Errorf("a %v listener needs a secret, its clients are authenticated by it", linkURL.Scheme)
+	}
+	if s := query.Get("replay"); s != "" {
+		window, err := strconv.Atoi(s)
+		if err != nil || window < 0 {
+			return fmt.Errorf("%v is not a valid replay window", s)
+		}
+		c, ok := cipher.(interface{ SetReplayWindow(int) })
+		if !ok {
+			return fmt.Errorf("replay needs secret")
 		}
+		c.SetReplayWindow(window)
 	}
 	switch linkURL.Scheme {
 	case "tls":
-		certFile := linkURL.Query().Get("cert")
-		keyFile := linkURL.Query().Get("key")
-		caCertFile := linkURL.Query().Get("cacert")
-		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
-		if err != nil {
-			return err
-		}
-		ca := x509.NewCertPool()
-		cacert, err := os.ReadFile(caCertFile)
+		creds, err := loadCredentials(vpn, query.Get("cert"), query.Get("key"), query.Get("cacert"))
 		if err != nil {
 			return err
 		}
-		if !ca.AppendCertsFromPEM(cacert) {
-			return fmt.Errorf("can't read CA certificate")
-		}
-		return newTLS(vpn, linkURL, certificate, ca)
-	case "ipip":
+		return newTLS(vpn, linkURL, creds, cipher)
+	case "tcp":
+		return newTCP(vpn, linkURL, cipher)
+	case "http", "https":
+		return newHTTP(vpn, linkURL, cipher)
+	case "ws", "wss":
+		return newWebSocket(vpn, linkURL, cipher)
+	case "ipip", "ipip6", "gre", "gre6":
 		return newIPIP(vpn, linkURL, cipher)
+	case "icmp":
+		return newICMP(vpn, linkURL, cipher)
 	case "udp":
-		return newUDP(vpn, linkURL, cipher)
+		return newUDP(vpn, linkURL, cipher, keys)
+	case "exec":
+		return newExec(vpn, linkURL, cipher)
+	case "stdio":
+		return newStdio(vpn, linkURL, cipher)
+	case "dns":
+		return newDNS(vpn, linkURL, cipher)
+	case "mem":
+		return newMem(vpn, linkURL, cipher)
 	default:
 		return fmt.Errorf("unknown link %s", linkURL.Scheme)
 	}
 }
+
+// needsSecret reports whether linkURL is a listener whose clients are only authenticated
+// by the secret. Without a secret, anyone could open sessions on it.
+func needsSecret(linkURL *url.URL) bool {
+	if linkURL.Hostname() != "" {
+		return false
+	}
+	switch linkURL.Scheme {
+	case "tcp", "http", "https", "ws", "wss", "dns":
+		return true
+	case "tls":
+		// The clients of HTTP links have no certificates.
+		return linkURL.Query().Get("http") != ""
+	}
+	return false
+}
+
+func loadCertPool(caCertFile string) (*x509.CertPool, error) {
+	ca := x509.NewCertPool()
+	cacert, err := os.ReadFile(caCertFile)
+	if err != nil {
+		return nil, err
+	}
+	if !ca.AppendCertsFromPEM(cacert) {
+		return nil, fmt.Errorf("can't read CA certificate")
+	}
+	return ca, nil
+}
@@ -0,0 +1,195 @@
+package link
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/clmul/cutevpn"
+)
+
+// testVPN runs links without routing, the added links are sent to links.
+type testVPN struct {
+	ctx   context.Context
+	wg    sync.WaitGroup
+	links chan cutevpn.Link
+}
+
+func newTestVPN(ctx context.Context) *testVPN {
+	return &testVPN{ctx: ctx, links: make(chan cutevpn.Link, 16)}
+}
+
+func (v *testVPN) Name() string              { return "test" }
+func (v *testVPN) Context() context.Context  { return v.ctx }
+func (v *testVPN) AddLink(link cutevpn.Link) { v.links <- link }
+
+func (v *testVPN) Go(f func()) {
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+		f()
+	}()
+}
+
+func (v *testVPN) OnCancel(ctx context.Context, f func()) {
+	v.Go(func() {
+		<-ctx.Done()
+		f()
+	})
+}
+
+func (v *testVPN) Loop(f func(context.Context) error) {
+	v.Go(func() {
+		for v.ctx.Err() == nil && f(v.ctx) == nil {
+		}
+	})
+}
+
+func randomPacket(n int) []byte {
+	p := make([]byte, n)
+	rand.Read(p)
+	return p
+}
+
+// recvPacket receives a packet from link, the empty packets and
+// the packet which opens an HTTP session are skipped.
+func recvPacket(t *testing.T, link cutevpn.Link) []byte {
+	buffer := make([]byte, 2048)
+	for {
+		p, _, err := link.Recv(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(p) > 0 && !bytes.Equal(p, keepaliveRequest) {
+			return p
+		}
+	}
+}
+
+func TestListenerNeedsSecret(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, s := range []string{
+		"tcp://127.0.0.1:0",
+		"http://:0/poll",
+		"ws://:0/path",
+		"dns://:0/?domain=t.example.com",
+		"tls://:0/?http=/poll&cert=cert.pem&key=key.pem",
+		"tcp://:0/?cipher=aesgcm",
+	} {
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Hostname() == "127.0.0.1" {
+			// A dialer doesn't need a secret.
+			if needsSecret(u) {
+				t.Fatalf("%v needs a secret", s)
+			}
+			continue
+		}
+		err = New(newTestVPN(ctx), u)
+		if err == nil {
+			t.Fatalf("%v is started without a secret", s)
+		}
+	}
+}
+
+// freePort returns a TCP port of 127.0.0.1 which isn't in use.
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// newTestLink creates the link of rawURL in vpn.
+func newTestLink(t *testing.T, vpn cutevpn.VPN, rawURL string) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = New(vpn, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitLink returns the next link added to vpn.
+func waitLink(t *testing.T, vpn *testVPN) cutevpn.Link {
+	select {
+	case link := <-vpn.links:
+		return link
+	case <-time.After(10 * time.Second):
+		t.Fatal("no link is added")
+		return nil
+	}
+}
+
+// exchange sends packets both ways between the ends of a link.
+func exchange(t *testing.T, server, client cutevpn.Link) {
+	for i := 0; i < 10; i++ {
+		up, down := randomPacket(1000), randomPacket(1000)
+		err := client.Send(append([]byte(nil), up...), client.Peer())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(recvPacket(t, server), up) {
+			t.Fatal("the packet to the server is changed")
+		}
+		err = server.Send(append([]byte(nil), down...), client.Peer())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(recvPacket(t, client), down) {
+			t.Fatal("the packet to the client is changed")
+		}
+	}
+}
+
+// closeOnError receives from link until it fails, and cancels it like the VPN.
+func closeOnError(link cutevpn.Link) {
+	buffer := make([]byte, 2048)
+	for {
+		_, _, err := link.Recv(buffer)
+		if err != nil {
+			link.Cancel()
+			return
+		}
+	}
+}
+
+// testReconnect exchanges packets on a stream link of scheme, and checks that
+// the dialer connects again when the listener closes the link.
+func testReconnect(t *testing.T, scheme string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	port := freePort(t)
+	serverVPN, clientVPN := newTestVPN(ctx), newTestVPN(ctx)
+	newTestLink(t, serverVPN, fmt.Sprintf("%v://:%v/cutevpn?secret=255a5b9021450fe59c4712f0e19c9607", scheme, port))
+	newTestLink(t, clientVPN, fmt.Sprintf("%v://127.0.0.1:%v/cutevpn?secret=255a5b9021450fe59c4712f0e19c9607", scheme, port))
+	server, client := waitLink(t, serverVPN), waitLink(t, clientVPN)
+	exchange(t, server, client)
+
+	server.Cancel()
+	closed := make(chan struct{})
+	go func() {
+		closeOnError(client)
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(15 * time.Second):
+		t.Fatal("the client keeps a closed connection")
+	}
+	server, client = waitLink(t, serverVPN), waitLink(t, clientVPN)
+	exchange(t, server, client)
+}
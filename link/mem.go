@@ -0,0 +1,146 @@
+package link
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+
+	"github.com/clmul/cutevpn"
+)
+
+// memHub is a virtual network segment shared by the mem links with the same name.
+// It connects VPNs in the same process, which is useful for tests.
+type memHub struct {
+	sync.Mutex
+	members map[memAddr]*mem
+	nextID  int
+}
+
+// memAddr identifies a member of a memHub.
+type memAddr string
+
+// memBroadcast is the Peer of every mem link.
+// A packet sent to it is delivered to all other members of the hub.
+const memBroadcast memAddr = "*"
+
+var memHubs = struct {
+	sync.Mutex
+	hubs map[string]*memHub
+}{hubs: make(map[string]*memHub)}
+
+type mem struct {
+	hub    *memHub
+	name   string
+	addr   memAddr
+	in     chan memPacket
+	cipher cutevpn.Cipher
+	stats  *cutevpn.LinkStats
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+type memPacket struct {
+	payload []byte
+	src     memAddr
+}
+
+func newMem(vpn cutevpn.VPN, linkURL *url.URL, cipher cutevpn.Cipher) error {
+	name := linkURL.Host
+	// memHubs is locked until the member is added, so the hub isn't removed before.
+	memHubs.Lock()
+	hub, ok := memHubs.hubs[name]
+	if !ok {
+		hub = &memHub{members: make(map[memAddr]*mem)}
+		memHubs.hubs[name] = hub
+	}
+
+	ctx, cancel := context.WithCancel(vpn.Context())
+	hub.Lock()
+	hub.nextID++
+	t := &mem{
+		hub:    hub,
+		name:   name,
+		addr:   memAddr(fmt.Sprintf("%v#%v", vpn.Name(), hub.nextID)),
+		in:     make(chan memPacket, 64),
+		cipher: cipher,
+		stats:  new(cutevpn.LinkStats),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	hub.members[t.addr] = t
+	hub.Unlock()
+	memHubs.Unlock()
+	vpn.OnCancel(ctx, func() {
+		memHubs.Lock()
+		defer memHubs.Unlock()
+		hub.Lock()
+		defer hub.Unlock()
+		delete(hub.members, t.addr)
+		// The hub is removed with its last member.
+		if len(hub.members) == 0 {
+			delete(memHubs.hubs, name)
+		}
+	})
+	vpn.AddLink(t)
+	return nil
+}
+
+func (t *mem) ToString(dst cutevpn.LinkAddr) string {
+	return fmt.Sprintf("mem %v %v->%v", t.name, t.addr, dst)
+}
+
+func (t *mem) Peer() cutevpn.LinkAddr {
+	return memBroadcast
+}
+
+// Send delivers packet to the member dst without blocking.
+// Like a real network, the packet is dropped if the receiver is busy.
+func (t *mem) Send(packet []byte, dst cutevpn.LinkAddr) error {
+	packet = t.cipher.Encrypt(packet)
+	t.hub.Lock()
+	defer t.hub.Unlock()
+	for addr, member := range t.hub.members {
+		if addr == t.addr || (dst != memBroadcast && dst != addr) {
+			continue
+		}
+		select {
+		case member.in <- memPacket{payload: append([]byte(nil), packet...), src: t.addr}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (t *mem) Recv(buffer []byte) (p []byte, addr cutevpn.LinkAddr, err error) {
+	select {
+	case <-t.ctx.Done():
+		return nil, nil, t.ctx.Err()
+	case packet := <-t.in:
+		n := copy(buffer, packet.payload)
+		p, err = t.cipher.Decrypt(buffer[:n])
+		if err != nil {
+			t.stats.AddDecryptError()
+			log.Println(err)
+			return buffer[:0], nil, nil
+		}
+		return p, packet.src, nil
+	}
+}
+
+func (t *mem) Overhead() int {
+	return t.cipher.Overhead()
+}
+
+func (t *mem) Cancel() {
+	t.cancel()
+}
+
+func (t *mem) Done() <-chan struct{} {
+	return t.ctx.Done()
+}
+
+func (t *mem) Stats() *cutevpn.LinkStats {
+	return t.stats
+}
@@ -0,0 +1,46 @@
+package link
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemHub(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	vpn := newTestVPN(ctx)
+	newTestLink(t, vpn, "mem://hub?secret=255a5b9021450fe59c4712f0e19c9607")
+	newTestLink(t, vpn, "mem://hub?secret=255a5b9021450fe59c4712f0e19c9607")
+	a, b := waitLink(t, vpn), waitLink(t, vpn)
+	p := randomPacket(1000)
+	err := a.Send(append([]byte(nil), p...), a.Peer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(recvPacket(t, b), p) {
+		t.Fatal("the packet is changed")
+	}
+
+	// The hub is removed when its last member leaves.
+	hasHub := func() bool {
+		memHubs.Lock()
+		defer memHubs.Unlock()
+		_, ok := memHubs.hubs["hub"]
+		return ok
+	}
+	a.Cancel()
+	time.Sleep(100 * time.Millisecond)
+	if !hasHub() {
+		t.Fatal("the hub is removed with a member left")
+	}
+	b.Cancel()
+	deadline := time.Now().Add(time.Second)
+	for hasHub() {
+		if time.Now().After(deadline) {
+			t.Fatal("the hub without members is kept")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,120 @@
+package link
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/clmul/cutevpn"
+	"github.com/clmul/cutevpn/encryption"
+)
+
+// The Noise of every static private key. The links with the same key share
+// the sessions, because the ipip links of a protocol share a socket.
+var noises = struct {
+	sync.Mutex
+	m map[string]*encryption.Noise
+}{m: make(map[string]*encryption.Noise)}
+
+// newNoiseCipher creates the cipher of a link with cipher=noise. A dialer
+// initiates the sessions with the public key of the listener, like
+// udp://server:1234/?cipher=noise&key=<private key>&peerkey=<public key of the server>,
+// and the listener allows the public keys of the dialers, like
+// udp://:1234/?cipher=noise&key=<private key>&allow=<public key>,<public key>.
+// The private key can be in secretfile= or secretenv= instead of key=.
+func newNoiseCipher(linkURL *url.URL) (cutevpn.Cipher, error) {
+	switch linkURL.Scheme {
+	case "udp", "ipip", "ipip6", "gre", "gre6", "icmp":
+	default:
+		return nil, fmt.Errorf("noise doesn't work on %v links", linkURL.Scheme)
+	}
+	query := linkURL.Query()
+	private, err := loadNoiseKey(query)
+	if err != nil {
+		return nil, err
+	}
+	noises.Lock()
+	noise, ok := noises.m[private]
+	if !ok {
+		key, err := hex.DecodeString(private)
+		if err != nil {
+			noises.Unlock()
+			return nil, err
+		}
+		noise, err = encryption.NewNoise(key)
+		if err != nil {
+			noises.Unlock()
+			return nil, err
+		}
+		noises.m[private] = noise
+		log.Printf("the noise public key is %x", noise.PublicKey())
+	}
+	noises.Unlock()
+	if allow := query.Get("allow"); allow != "" {
+		for _, s := range strings.Split(allow, ",") {
+			key, err := hex.DecodeString(s)
+			if err != nil {
+				return nil, err
+			}
+			err = noise.Allow(key)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	var peerKey []byte
+	if s := query.Get("peerkey"); s != "" {
+		var err error
+		peerKey, err = hex.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if peerKey == nil && linkURL.Hostname() != "" {
+		return nil, fmt.Errorf("a noise dialer needs peerkey")
+	}
+	return noise.Cipher(peerKey)
+}
+
+// loadNoiseKey returns the private key of key=, or the newest secret of
+// secretfile= or secretenv=, so the key isn't in config.toml.
+func loadNoiseKey(query url.Values) (string, error) {
+	if query.Get("key") != "" {
+		if hasSecret(query) {
+			return "", fmt.Errorf("noise needs only one of key, secret, secretfile and secretenv")
+		}
+		return query.Get("key"), nil
+	}
+	if !hasSecret(query) {
+		return "", fmt.Errorf("noise needs key")
+	}
+	secrets, err := loadSecrets(query)
+	if err != nil {
+		return "", err
+	}
+	for _, secret := range secrets {
+		if key, staged := encryption.Unstage(secret); !staged {
+			return key, nil
+		}
+	}
+	return "", fmt.Errorf("every noise key is staged")
+}
+
+// encryptTo encrypts a packet to dst, by the session with dst if cipher keeps sessions.
+func encryptTo(cipher cutevpn.Cipher, packet []byte, dst cutevpn.LinkAddr) []byte {
+	if c, ok := cipher.(cutevpn.PeerCipher); ok {
+		return c.EncryptTo(packet, dst)
+	}
+	return cipher.Encrypt(packet)
+}
+
+// decryptFrom decrypts a packet from src, by the session with src if cipher keeps sessions.
+func decryptFrom(cipher cutevpn.Cipher, packet []byte, src cutevpn.LinkAddr) ([]byte, error) {
+	if c, ok := cipher.(cutevpn.PeerCipher); ok {
+		return c.DecryptFrom(packet, src)
+	}
+	return cipher.Decrypt(packet)
+}
@@ -0,0 +1,58 @@
+package link
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestNoiseKey(t *testing.T) {
+	const key = "6b1e4d7f0a2c9e8b3d5f7a1c0e2b4d6f8a9c1e3b5d7f9a0c2e4b6d8f0a1c3e5b"
+	file := filepath.Join(t.TempDir(), "key")
+	err := os.WriteFile(file, []byte(key+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CUTEVPN_NOISE_KEY", key)
+	for _, s := range []string{
+		"udp://:1234/?cipher=noise&key=" + key,
+		"udp://:1234/?cipher=noise&secretfile=" + file,
+		"udp://:1234/?cipher=noise&secretenv=CUTEVPN_NOISE_KEY",
+	} {
+		u, _ := url.Parse(s)
+		private, err := loadNoiseKey(u.Query())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if private != key {
+			t.Fatalf("the key of %v is %v", s, private)
+		}
+	}
+	for _, s := range []string{
+		"udp://:1234/?cipher=noise",
+		"udp://:1234/?cipher=noise&key=" + key + "&secretenv=CUTEVPN_NOISE_KEY",
+	} {
+		u, _ := url.Parse(s)
+		_, err := loadNoiseKey(u.Query())
+		if err == nil {
+			t.Fatalf("%v is accepted", s)
+		}
+	}
+
+	// The links of a key share its Noise, even if they are created at once.
+	u, _ := url.Parse("udp://:1234/?cipher=noise&key=" + key)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := newNoiseCipher(u)
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,115 @@
+package link
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/clmul/cutevpn"
+)
+
+// pollLink is an end of a session of a request and response transport,
+// like HTTP and DNS. The packets are queued until the transport takes them.
+type pollLink struct {
+	cipher cutevpn.Cipher
+	// encrypted packets
+	out    chan []byte
+	in     chan []byte
+	stats  *cutevpn.LinkStats
+	kind   string
+	local  string
+	remote string
+	peer   cutevpn.LinkAddr
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// time.Now().UnixNano() when the last request is received, accessed atomically.
+	// It's only used by the server.
+	lastSeen int64
+}
+
+// openingPacket is the first packet of a session, the server opens the session if it's
+// decrypted. It's a keepalive request, which is a signal.
+func openingPacket(cipher cutevpn.Cipher) []byte {
+	return cipher.Encrypt(append([]byte(nil), keepaliveRequest...))
+}
+
+func newPollLink(ctx context.Context, config streamConfig, kind, local, remote string, peer cutevpn.LinkAddr) *pollLink {
+	ctx, cancel := context.WithCancel(ctx)
+	return &pollLink{
+		cipher:   config.cipher,
+		out:      make(chan []byte, config.queue),
+		in:       make(chan []byte, config.queue),
+		stats:    new(cutevpn.LinkStats),
+		kind:     kind,
+		local:    local,
+		remote:   remote,
+		peer:     peer,
+		ctx:      ctx,
+		cancel:   cancel,
+		lastSeen: time.Now().UnixNano(),
+	}
+}
+
+func (l *pollLink) Send(packet []byte, dst cutevpn.LinkAddr) error {
+	select {
+	case l.out <- l.cipher.Encrypt(packet):
+	default:
+		l.stats.AddDropped()
+	}
+	return nil
+}
+
+func (l *pollLink) Recv(buffer []byte) (p []byte, addr cutevpn.LinkAddr, err error) {
+	select {
+	case <-l.ctx.Done():
+		return nil, nil, l.ctx.Err()
+	case packet := <-l.in:
+		n := copy(buffer, packet)
+		p, err = l.cipher.Decrypt(buffer[:n])
+		if err != nil {
+			l.stats.AddDecryptError()
+			log.Println(err)
+			return buffer[:0], nil, nil
+		}
+		return p, l.remote, nil
+	}
+}
+
+func (l *pollLink) Peer() cutevpn.LinkAddr {
+	return l.peer
+}
+
+func (l *pollLink) Overhead() int {
+	return -1
+}
+
+func (l *pollLink) ToString(dst cutevpn.LinkAddr) string {
+	return fmt.Sprintf("%v %v->%v", l.kind, l.local, l.remote)
+}
+
+func (l *pollLink) Cancel() {
+	l.cancel()
+}
+
+func (l *pollLink) Done() <-chan struct{} {
+	return l.ctx.Done()
+}
+
+func (l *pollLink) Stats() *cutevpn.LinkStats {
+	return l.stats
+}
+
+// receive passes the received packets to Recv.
+func (l *pollLink) receive(ctx context.Context, packets [][]byte) {
+	for _, p := range packets {
+		select {
+		case l.in <- p:
+		case <-l.ctx.Done():
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
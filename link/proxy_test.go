@@ -0,0 +1,153 @@
+package link
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/clmul/socks5"
+)
+
+// listenHTTPProxy starts an HTTP CONNECT proxy which requires user:password.
+func listenHTTPProxy(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:password"))
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				if req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != auth {
+					io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+				upstream, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer upstream.Close()
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return l
+}
+
+// listenSOCKS5Proxy starts a SOCKS5 proxy which requires user:password.
+func listenSOCKS5Proxy(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := socks5.New(&socks5.Config{
+		Credentials: socks5.StaticCredentials{"user": "password"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(l)
+	return l
+}
+
+// testProxy exchanges packets on a tcp link whose dialer connects through proxy.
+func testProxy(t *testing.T, proxy string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	port := freePort(t)
+	serverVPN, clientVPN := newTestVPN(ctx), newTestVPN(ctx)
+	newTestLink(t, serverVPN, fmt.Sprintf("tcp://:%v/?secret=255a5b9021450fe59c4712f0e19c9607", port))
+	newTestLink(t, clientVPN, fmt.Sprintf("tcp://127.0.0.1:%v/?secret=255a5b9021450fe59c4712f0e19c9607&proxy=%v", port, url.QueryEscape(proxy)))
+	server, client := waitLink(t, serverVPN), waitLink(t, clientVPN)
+	exchange(t, server, client)
+}
+
+func TestHTTPProxy(t *testing.T) {
+	l := listenHTTPProxy(t)
+	defer l.Close()
+	testProxy(t, fmt.Sprintf("http://user:password@%v", l.Addr()))
+
+	u, _ := url.Parse(fmt.Sprintf("tcp://server?proxy=http://user:wrong@%v", l.Addr()))
+	dial, err := newDialer(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dial(context.Background(), "127.0.0.1:1")
+	if err == nil {
+		t.Fatal("the proxy accepts a wrong password")
+	}
+}
+
+func TestSOCKS5Proxy(t *testing.T) {
+	l := listenSOCKS5Proxy(t)
+	defer l.Close()
+	testProxy(t, fmt.Sprintf("socks5://user:password@%v", l.Addr()))
+
+	u, _ := url.Parse(fmt.Sprintf("tcp://server?proxy=socks5://user:wrong@%v", l.Addr()))
+	dial, err := newDialer(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dial(context.Background(), "127.0.0.1:1")
+	if err == nil {
+		t.Fatal("the proxy accepts a wrong password")
+	}
+}
+
+func TestHTTPProxyEarlyData(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, err = http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		// The data of the server is sent with the response.
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\nhello")
+		io.Copy(io.Discard, conn)
+	}()
+	conn, err := dialHTTPProxy(context.Background(), &url.URL{Host: l.Addr().String()}, "127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buffer := make([]byte, 5)
+	_, err = io.ReadFull(conn, buffer)
+	if err != nil || string(buffer) != "hello" {
+		t.Fatalf("the data after the response is %q: %v", buffer, err)
+	}
+}
+
+func TestUnknownProxy(t *testing.T) {
+	u, _ := url.Parse("tcp://server?proxy=ftp://proxy:21")
+	_, err := newDialer(u)
+	if err == nil {
+		t.Fatal("an ftp proxy is accepted")
+	}
+}
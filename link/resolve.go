@@ -0,0 +1,101 @@
+package link
+
+import (
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/clmul/cutevpn"
+)
+
+const (
+	// The default interval of resolving the hostname of a peer again.
+	defaultResolveInterval = 10 * time.Minute
+	// A link is idle if it receives nothing in idleTimeout.
+	// OSPF sends Hello packets more often than it.
+	idleTimeout = 30 * time.Second
+	// The delay before replacing a dead link.
+	relinkDelay = 5 * time.Second
+)
+
+// watchPeer keeps a link to the hostname of linkURL when the address of the hostname changes.
+//
+// The hostname is resolved again every resolve= interval of linkURL,
+// and also when the link is idle or dead. If the address changes,
+// the link is canceled and OSPF removes its routes like any dead link,
+// then a new link to the new address is started by relink.
+// A dead link is replaced even if the address doesn't change.
+func watchPeer(vpn cutevpn.VPN, linkURL *url.URL, link cutevpn.Link,
+	resolve func(host string) (cutevpn.LinkAddr, error),
+	relink func(peer cutevpn.LinkAddr) (cutevpn.Link, error)) error {
+
+	interval := defaultResolveInterval
+	if s := linkURL.Query().Get("resolve"); s != "" {
+		var err error
+		interval, err = time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+	}
+	// A link is checked every idleTimeout, or every interval if it's shorter.
+	period := idleTimeout
+	if interval > 0 && interval < period {
+		period = interval
+	}
+	host := linkURL.Hostname()
+	vpn.Go(func() {
+		tick := time.NewTicker(period)
+		defer tick.Stop()
+		lastResolve := time.Now()
+		lastRecv := link.Stats().Load().RecvPackets
+		for {
+			dead := false
+			select {
+			case <-vpn.Context().Done():
+				return
+			case <-link.Done():
+				dead = true
+			case <-tick.C:
+			}
+			recv := link.Stats().Load().RecvPackets
+			idle := recv == lastRecv
+			lastRecv = recv
+			if !dead && !idle && (interval <= 0 || time.Since(lastResolve) < interval) {
+				continue
+			}
+			if dead {
+				select {
+				case <-vpn.Context().Done():
+					return
+				case <-time.After(relinkDelay):
+				}
+			}
+			lastResolve = time.Now()
+			peer, err := resolve(host)
+			if err != nil {
+				log.Println(err)
+				if dead {
+					// Keep the old address, and resolve it again on the next tick.
+					peer = link.Peer()
+				} else {
+					continue
+				}
+			}
+			if !dead && peer == link.Peer() {
+				continue
+			}
+			if peer != link.Peer() {
+				log.Printf("the address of %v changed from %v to %v", host, link.Peer(), peer)
+			}
+			link.Cancel()
+			next, err := relink(peer)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			link = next
+			lastRecv = 0
+		}
+	})
+	return nil
+}
@@ -0,0 +1,123 @@
+package link
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/clmul/cutevpn"
+)
+
+// peerLink is a link which only has a peer, it receives nothing.
+type peerLink struct {
+	peer   cutevpn.LinkAddr
+	stats  *cutevpn.LinkStats
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newPeerLink(ctx context.Context, peer cutevpn.LinkAddr) *peerLink {
+	ctx, cancel := context.WithCancel(ctx)
+	return &peerLink{peer: peer, stats: new(cutevpn.LinkStats), ctx: ctx, cancel: cancel}
+}
+
+func (l *peerLink) Send(packet []byte, dst cutevpn.LinkAddr) error { return nil }
+func (l *peerLink) Recv(buffer []byte) ([]byte, cutevpn.LinkAddr, error) {
+	<-l.ctx.Done()
+	return nil, nil, l.ctx.Err()
+}
+func (l *peerLink) Peer() cutevpn.LinkAddr               { return l.peer }
+func (l *peerLink) Overhead() int                        { return 0 }
+func (l *peerLink) ToString(dst cutevpn.LinkAddr) string { return "peer" }
+func (l *peerLink) Cancel()                              { l.cancel() }
+func (l *peerLink) Done() <-chan struct{}                { return l.ctx.Done() }
+func (l *peerLink) Stats() *cutevpn.LinkStats            { return l.stats }
+
+func TestWatchPeer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	vpn := newTestVPN(ctx)
+
+	var lock sync.Mutex
+	addr, resolveErr := "a", error(nil)
+	setAddr := func(a string, err error) {
+		lock.Lock()
+		addr, resolveErr = a, err
+		lock.Unlock()
+	}
+	resolve := func(host string) (cutevpn.LinkAddr, error) {
+		if host != "server" {
+			t.Errorf("%v is resolved", host)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		return addr, resolveErr
+	}
+	relinked := make(chan *peerLink, 16)
+	relink := func(peer cutevpn.LinkAddr) (cutevpn.Link, error) {
+		link := newPeerLink(ctx, peer)
+		relinked <- link
+		return link, nil
+	}
+	waitRelink := func(timeout time.Duration) *peerLink {
+		select {
+		case link := <-relinked:
+			return link
+		case <-time.After(timeout):
+			t.Fatal("the link isn't replaced")
+			return nil
+		}
+	}
+
+	u, _ := url.Parse("udp://server:12345/?resolve=50ms")
+	link := newPeerLink(ctx, "a")
+	err := watchPeer(vpn, u, link, resolve, relink)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The link is kept while the address is the same, or it can't be resolved.
+	setAddr("a", errors.New("no such host"))
+	time.Sleep(300 * time.Millisecond)
+	setAddr("a", nil)
+	time.Sleep(300 * time.Millisecond)
+	select {
+	case <-relinked:
+		t.Fatal("a link to the same address is replaced")
+	case <-link.Done():
+		t.Fatal("a link to the same address is canceled")
+	default:
+	}
+
+	// The link is replaced when the address changes.
+	setAddr("b", nil)
+	next := waitRelink(2 * time.Second)
+	if next.Peer() != "b" {
+		t.Fatalf("the new link is to %v", next.Peer())
+	}
+	select {
+	case <-link.Done():
+	default:
+		t.Fatal("the link to the old address isn't canceled")
+	}
+
+	// A dead link is replaced after relinkDelay, with the old address if the hostname can't be resolved.
+	setAddr("c", errors.New("no such host"))
+	start := time.Now()
+	next.Cancel()
+	last := waitRelink(relinkDelay + 2*time.Second)
+	if time.Since(start) < relinkDelay {
+		t.Fatal("a dead link is replaced without a delay")
+	}
+	if last.Peer() != "b" {
+		t.Fatalf("the new link is to %v", last.Peer())
+	}
+
+	u, _ = url.Parse("udp://server:12345/?resolve=never")
+	if watchPeer(vpn, u, link, resolve, relink) == nil {
+		t.Fatal("resolve=never is accepted")
+	}
+}
@@ -0,0 +1,214 @@
+package link
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/clmul/cutevpn"
+	"github.com/clmul/cutevpn/encryption"
+)
+
+// hasSecret reports whether the link is encrypted by a shared secret.
+func hasSecret(query url.Values) bool {
+	return query.Get("secret") != "" || query.Get("secretfile") != "" || query.Get("secretenv") != ""
+}
+
+// loadSecrets returns the secrets of a link, the newest one is the first.
+// They are the comma separated list of secret= or of the environment variable secretenv=,
+// or the lines of secretfile=. They are passphrases if the link has kdf=.
+func loadSecrets(query url.Values) ([]string, error) {
+	var sources []string
+	for _, key := range []string{"secret", "secretfile", "secretenv"} {
+		if query.Get(key) != "" {
+			sources = append(sources, key)
+		}
+	}
+	if len(sources) > 1 {
+		return nil, fmt.Errorf("only one of %v can be used", strings.Join(sources, ", "))
+	}
+	var secrets []string
+	switch {
+	case query.Get("secretfile") != "":
+		var err error
+		secrets, err = readSecretFile(query.Get("secretfile"))
+		if err != nil {
+			return nil, err
+		}
+	case query.Get("secretenv") != "":
+		name := query.Get("secretenv")
+		value := os.Getenv(name)
+		if value == "" {
+			return nil, fmt.Errorf("the environment variable %v is empty", name)
+		}
+		secrets = strings.Split(value, ",")
+	case query.Get("secret") != "":
+		secrets = strings.Split(query.Get("secret"), ",")
+	}
+	return deriveKeys(query, secrets)
+}
+
+// deriveKeys derives the keys of passphrases by kdf= and salt=, or returns secrets if the link has no kdf.
+func deriveKeys(query url.Values, secrets []string) ([]string, error) {
+	kdf := query.Get("kdf")
+	if kdf == "" {
+		return secrets, nil
+	}
+	keys := make([]string, len(secrets))
+	for i, passphrase := range secrets {
+		passphrase, staged := encryption.Unstage(passphrase)
+		key, err := encryption.DeriveKey(kdf, passphrase, query.Get("salt"))
+		if err != nil {
+			return nil, err
+		}
+		if staged {
+			key = encryption.StagedPrefix + key
+		}
+		keys[i] = key
+	}
+	return keys, nil
+}
+
+// readSecretFile reads a secret in every line. Empty lines and lines starting with # are skipped.
+// A staged secret starts with encryption.StagedPrefix.
+// It warns if other users can access the file.
+func readSecretFile(name string) ([]string, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		log.Printf("%v can be accessed by other users, its mode should be 0600", name)
+	}
+	content, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var secrets []string
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		secrets = append(secrets, line)
+	}
+	if len(secrets) == 0 {
+		return nil, fmt.Errorf("%v has no secret", name)
+	}
+	return secrets, nil
+}
+
+// newSecretCipher creates the cipher of the secrets of a link. A link with more than one
+// secret or a secretfile has a keyring, and the secretfile is watched until vpn stops.
+// The keys are returned for the other uses of the secrets, like hop.
+func newSecretCipher(vpn cutevpn.VPN, query url.Values) (cutevpn.Cipher, *keySet, error) {
+	secrets, err := loadSecrets(query)
+	if err != nil {
+		return nil, nil, err
+	}
+	keys := &keySet{keys: secrets}
+	name := query.Get("cipher")
+	file := query.Get("secretfile")
+	// A single staged secret is rejected by the keyring.
+	_, staged := encryption.Unstage(secrets[0])
+	if file == "" && len(secrets) == 1 && !staged {
+		cipher, err := encryption.New(name, secrets[0])
+		return cipher, keys, err
+	}
+	ring, err := encryption.NewKeyring(name, secrets)
+	if err != nil {
+		return nil, nil, err
+	}
+	if file != "" {
+		s := &secretFile{name: file, query: query, ring: ring, keys: keys}
+		s.modTime, err = s.stat()
+		if err != nil {
+			return nil, nil, err
+		}
+		watchFiles(vpn, s)
+	}
+	return ring, keys, nil
+}
+
+// keySet is the current keys of a link, the newest one is the first. The staged keys
+// have encryption.StagedPrefix.
+// It changes when the secretfile of the link is reloaded.
+type keySet struct {
+	lock sync.RWMutex
+	keys []string
+}
+
+func (k *keySet) set(keys []string) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.keys = keys
+}
+
+// oldest returns the last key. While a newer key is rotated in, every node still has the oldest one.
+func (k *keySet) oldest() string {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	key, _ := encryption.Unstage(k.keys[len(k.keys)-1])
+	return key
+}
+
+// secretFile is the file of the secrets of a keyring.
+type secretFile struct {
+	name  string
+	query url.Values
+	ring  *encryption.Keyring
+	keys  *keySet
+
+	lock    sync.Mutex
+	modTime time.Time
+}
+
+func (s *secretFile) String() string {
+	return s.name
+}
+
+func (s *secretFile) stat() (time.Time, error) {
+	info, err := os.Stat(s.name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+func (s *secretFile) changed() bool {
+	modTime, err := s.stat()
+	if err != nil {
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return !modTime.Equal(s.modTime)
+}
+
+func (s *secretFile) reload() error {
+	modTime, err := s.stat()
+	if err != nil {
+		return err
+	}
+	secrets, err := readSecretFile(s.name)
+	if err != nil {
+		return err
+	}
+	secrets, err = deriveKeys(s.query, secrets)
+	if err != nil {
+		return err
+	}
+	err = s.ring.Set(secrets)
+	if err != nil {
+		return err
+	}
+	s.keys.set(secrets)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.modTime = modTime
+	return nil
+}
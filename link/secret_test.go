@@ -0,0 +1,108 @@
+package link
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/clmul/cutevpn/encryption"
+)
+
+func TestSecretFile(t *testing.T) {
+	oldKey, newKey := "255a5b9021450fe59c4712f0e19c9607", "8a6e34ac1f6d6bd5d3b8c1f4d0b0b6a9"
+	name := filepath.Join(t.TempDir(), "secret")
+	write := func(content string, modTime time.Time) {
+		t.Helper()
+		err := os.WriteFile(name, []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(name, modTime, modTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	write("# the secret of the mesh\n"+oldKey+"\n\n", now.Add(-time.Minute))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	query := url.Values{"secretfile": {name}}
+	cipher, keys, err := newSecretCipher(newTestVPN(ctx), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ring := cipher.(*encryption.Keyring)
+	old, _ := encryption.New("", oldKey)
+	_, err = ring.Decrypt(old.Encrypt([]byte("packet")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A staged secret is accepted, but the packets are still encrypted by the old one.
+	write(encryption.StagedPrefix+newKey+"\n"+oldKey+"\n", now)
+	s := &secretFile{name: name, query: query, ring: ring, keys: keys, modTime: now.Add(-time.Minute)}
+	if !s.changed() {
+		t.Fatal("the change of the file isn't detected")
+	}
+	err = s.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newer, _ := encryption.New("", newKey)
+	_, err = ring.Decrypt(newer.Encrypt([]byte("packet")))
+	if err != nil {
+		t.Fatal("the staged secret isn't accepted")
+	}
+	_, err = old.Decrypt(ring.Encrypt([]byte("packet")))
+	if err != nil || keys.oldest() != oldKey {
+		t.Fatal("the staged secret is used")
+	}
+
+	write(newKey+"\n"+oldKey+"\n", now)
+	err = s.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = newer.Decrypt(ring.Encrypt([]byte("packet")))
+	if err != nil {
+		t.Fatal("the newest secret isn't used after reloading")
+	}
+	write(newKey+"\n", now.Add(time.Second))
+	err = s.reload()
+	if err != nil || keys.oldest() != newKey {
+		t.Fatalf("the oldest key is %v after reloading: %v", keys.oldest(), err)
+	}
+
+	// An empty file keeps the old secrets.
+	write("\n", now.Add(time.Minute))
+	if s.reload() == nil {
+		t.Fatal("the empty file is loaded")
+	}
+
+	query = url.Values{"secret": {newKey + "," + oldKey}, "secretfile": {name}}
+	_, _, err = newSecretCipher(newTestVPN(ctx), query)
+	if err == nil {
+		t.Fatal("secret and secretfile are used together")
+	}
+}
+
+func TestSecretEnv(t *testing.T) {
+	t.Setenv("CUTEVPN_TEST_SECRET", "new passphrase,old passphrase")
+	query := url.Values{"secretenv": {"CUTEVPN_TEST_SECRET"}, "kdf": {"scrypt"}, "salt": {"mesh.example"}}
+	secrets, err := loadSecrets(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := encryption.DeriveKey("scrypt", "old passphrase", "mesh.example")
+	if len(secrets) != 2 || secrets[1] != key {
+		t.Fatalf("the secrets are %v", secrets)
+	}
+	_, err = loadSecrets(url.Values{"secretenv": {"CUTEVPN_TEST_NOTHING"}})
+	if err == nil {
+		t.Fatal("an empty environment variable is accepted")
+	}
+}
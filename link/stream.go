@@ -1,59 +1,85 @@
 package link
 
 import (
-	"bufio"
 	"bytes"
 	"context"
-	"crypto/tls"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/clmul/cutevpn"
 )
 
+// framer reads and writes whole packets on a byte stream.
+type framer interface {
+	WritePackets(packets [][]byte) error
+	ReadPacket(buffer []byte) ([]byte, error)
+}
+
+// streamConfig is the configuration of the streams of a link URL.
+type streamConfig struct {
+	cipher cutevpn.Cipher
+	// the max number of packets waiting to be sent
+	queue int
+}
+
+func parseStreamConfig(linkURL *url.URL, cipher cutevpn.Cipher) (streamConfig, error) {
+	config := streamConfig{
+		cipher: cipher,
+		queue:  4,
+	}
+	if queue := linkURL.Query().Get("queue"); queue != "" {
+		n, err := strconv.Atoi(queue)
+		if err != nil || n <= 0 {
+			return config, fmt.Errorf("%v is not a valid queue size", queue)
+		}
+		config.queue = n
+	}
+	return config, nil
+}
+
 type stream struct {
 	conn   net.Conn
+	framer framer
+	cipher cutevpn.Cipher
 	out    chan []byte
+	stats  *cutevpn.LinkStats
 	isIPv6 bool
 
+	kind   string
 	peer   cutevpn.LinkAddr
 	local  string
 	remote string
 
 	ctx    context.Context
 	cancel context.CancelFunc
-
-	scanner *bufio.Scanner
 }
 
-func newStream(ctx context.Context, vpn cutevpn.VPN, conn net.Conn, peer cutevpn.LinkAddr) *stream {
-	scanner := bufio.NewScanner(conn)
-	scanner.Split(split)
+// newStream starts a Link on conn.
+// kind is the name of the transport, local is the local address of the
+// underlying connection, and remote is a readable name of the other end.
+// peer is nil if conn is accepted by a listener.
+func newStream(ctx context.Context, vpn cutevpn.VPN, conn net.Conn, f framer, config streamConfig, kind string, local net.Addr, remote string, peer cutevpn.LinkAddr) *stream {
 	ctx, cancel := context.WithCancel(ctx)
-	localAddr, localPort, _ := net.SplitHostPort(conn.LocalAddr().String())
-	_, remotePort, _ := net.SplitHostPort(conn.RemoteAddr().String())
-	var remote string
-	if peer != nil {
-		remote = peer.(string)
-	} else {
-		tlsConn := conn.(*tls.Conn)
-		remote = tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
-		remote = fmt.Sprintf("%v:%v", remote, remotePort)
-	}
+	localAddr, localPort, _ := net.SplitHostPort(local.String())
 	d := &stream{
-		conn:    conn,
-		isIPv6:  strings.Contains(localAddr, ":"),
-		out:     make(chan []byte, 4),
-		peer:    peer,
-		local:   fmt.Sprintf("local:%v", localPort),
-		remote:  remote,
-		ctx:     ctx,
-		cancel:  cancel,
-		scanner: scanner,
+		conn:   conn,
+		framer: f,
+		cipher: config.cipher,
+		isIPv6: strings.Contains(localAddr, ":"),
+		out:    make(chan []byte, config.queue),
+		stats:  new(cutevpn.LinkStats),
+		kind:   kind,
+		peer:   peer,
+		local:  fmt.Sprintf("local:%v", localPort),
+		remote: remote,
+		ctx:    ctx,
+		cancel: cancel,
 	}
 	vpn.Go(func() {
 		d.sendLoop()
@@ -64,13 +90,21 @@ func newStream(ctx context.Context, vpn cutevpn.VPN, conn net.Conn, peer cutevpn
 	return d
 }
 
+// sendLoop writes the queued packets.
+// All the packets in the queue are coalesced into one write.
 func (d *stream) sendLoop() {
+	packets := make([][]byte, 0, cap(d.out))
 	for {
 		select {
 		case <-d.ctx.Done():
 			return
 		case packet := <-d.out:
-			err := send(d.conn, packet)
+			packets = append(packets[:0], d.cipher.Encrypt(packet))
+			for n := len(d.out); n > 0; n-- {
+				packets = append(packets, d.cipher.Encrypt(<-d.out))
+			}
+			d.conn.SetWriteDeadline(time.Now().Add(time.Second))
+			err := d.framer.WritePackets(packets)
 			if err != nil {
 				log.Println(err)
 				d.cancel()
@@ -80,26 +114,24 @@ func (d *stream) sendLoop() {
 	}
 }
 
-func send(conn net.Conn, packet []byte) error {
-	conn.SetWriteDeadline(time.Now().Add(time.Second))
-	_, err := conn.Write(addSep(packet))
-	return err
-}
-
 func recv(d *stream, buffer []byte) ([]byte, error) {
 	d.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
-	if !d.scanner.Scan() {
-		return nil, d.scanner.Err()
+	p, err := d.framer.ReadPacket(buffer)
+	if err != nil {
+		return nil, err
+	}
+	p, err = d.cipher.Decrypt(p)
+	if err != nil {
+		d.stats.AddDecryptError()
 	}
-	payload := d.scanner.Bytes()
-	n := copy(buffer, payload)
-	return buffer[:n], nil
+	return p, err
 }
 
 func (d *stream) Send(packet []byte, dst cutevpn.LinkAddr) error {
 	select {
 	case d.out <- packet:
 	default:
+		d.stats.AddDropped()
 	}
 	return nil
 }
@@ -122,7 +154,7 @@ func (d *stream) ToString(dst cutevpn.LinkAddr) string {
 	if d.isIPv6 {
 		ipVersion = "ipv6"
 	}
-	return fmt.Sprintf("tls %v %v->%v", ipVersion, d.local, d.remote)
+	return fmt.Sprintf("%v %v %v->%v", d.kind, ipVersion, d.local, d.remote)
 }
 
 func (d *stream) Cancel() {
@@ -133,6 +165,41 @@ func (d *stream) Done() <-chan struct{} {
 	return d.ctx.Done()
 }
 
+func (d *stream) Stats() *cutevpn.LinkStats {
+	return d.stats
+}
+
+// A session shorter than stableSession is counted as a failure,
+// so a server which closes every connection at once isn't dialed in a busy loop.
+const stableSession = 30 * time.Second
+
+// connect dials a link, adds it to vpn and waits for it to be done.
+// Failed dials are retried with backoff until ctx is canceled.
+// The backoff is reset by returning after a stable session.
+func connect(ctx context.Context, vpn cutevpn.VPN, dial func(ctx context.Context) (cutevpn.Link, error)) error {
+	var b backoff
+	for {
+		peer, err := dial(ctx)
+		if err != nil {
+			log.Println(err)
+		} else {
+			start := time.Now()
+			vpn.AddLink(peer)
+			<-peer.Done()
+			if time.Since(start) >= stableSession {
+				return nil
+			}
+		}
+		delay := b.next()
+		log.Printf("reconnect in %v", delay.Round(time.Millisecond))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
 func split(data []byte, atEOF bool) (advance int, token []byte, err error) {
 	if atEOF {
 		return 0, nil, io.ErrUnexpectedEOF
@@ -151,16 +218,16 @@ func split(data []byte, atEOF bool) (advance int, token []byte, err error) {
 	return
 }
 
-func addSep(p []byte) []byte {
+// appendSep appends p with a separator on both sides to dst.
+func appendSep(dst, p []byte) []byte {
 	var sep0 [4]byte
 	sep := sep0[:1]
 	for ; bytes.Index(p, sep) >= 0; sep = nextSep(sep) {
 	}
-	r := make([]byte, 0, 2048)
-	r = append(r, sep...)
-	r = append(r, p...)
-	r = append(r, sep...)
-	return r
+	dst = append(dst, sep...)
+	dst = append(dst, p...)
+	dst = append(dst, sep...)
+	return dst
 }
 
 func nextSep(sep []byte) []byte {
@@ -0,0 +1,63 @@
+package link
+
+import (
+	"context"
+	"net"
+	"net/url"
+
+	"github.com/clmul/cutevpn"
+)
+
+// newTCP creates a stream link on a raw TCP connection.
+// Packets are encrypted by cipher, so only a shared secret is required.
+func newTCP(vpn cutevpn.VPN, linkURL *url.URL, cipher cutevpn.Cipher) error {
+	config, err := parseStreamConfig(linkURL, cipher)
+	if err != nil {
+		return err
+	}
+	if linkURL.Hostname() == "" {
+		return newTCPListener(vpn, linkURL, config)
+	}
+	return newTCPDialer(vpn, linkURL, config)
+}
+
+func newTCPListener(vpn cutevpn.VPN, linkURL *url.URL, config streamConfig) error {
+	listener, err := net.Listen("tcp", linkURL.Host)
+	if err != nil {
+		return err
+	}
+	vpn.OnCancel(vpn.Context(), func() {
+		listener.Close()
+	})
+	vpn.Loop(func(ctx context.Context) error {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		peer := newStream(ctx, vpn, conn, newStreamFramer(conn, config.cipher), config, "tcp", conn.LocalAddr(), conn.RemoteAddr().String(), nil)
+		vpn.AddLink(peer)
+		return nil
+	})
+	return nil
+}
+
+func newTCPDialer(vpn cutevpn.VPN, linkURL *url.URL, config streamConfig) error {
+	dial, err := newDialer(linkURL)
+	if err != nil {
+		return err
+	}
+	servers, err := newEndpoints(linkURL, dial)
+	if err != nil {
+		return err
+	}
+	vpn.Loop(func(ctx context.Context) error {
+		return connect(ctx, vpn, func(ctx context.Context) (cutevpn.Link, error) {
+			conn, err := servers.Dial(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return newStream(ctx, vpn, conn, newStreamFramer(conn, config.cipher), config, "tcp", conn.LocalAddr(), linkURL.Host, linkURL.Host), nil
+		})
+	})
+	return nil
+}
@@ -0,0 +1,35 @@
+package link
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestTCP(t *testing.T) {
+	testReconnect(t, "tcp")
+}
+
+func TestTCPWrongSecret(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	port := freePort(t)
+	serverVPN, clientVPN := newTestVPN(ctx), newTestVPN(ctx)
+	newTestLink(t, serverVPN, fmt.Sprintf("tcp://:%v/?secret=255a5b9021450fe59c4712f0e19c9607", port))
+	newTestLink(t, clientVPN, fmt.Sprintf("tcp://127.0.0.1:%v/?secret=41fa34cd493a5955e185b36abb117a6f", port))
+	server, client := waitLink(t, serverVPN), waitLink(t, clientVPN)
+	client.Send(randomPacket(1000), nil)
+	buffer := make([]byte, 2048)
+	for {
+		p, _, err := server.Recv(buffer)
+		if err != nil {
+			break
+		}
+		if len(p) > 0 {
+			t.Fatal("a packet of another secret is received")
+		}
+	}
+	if server.Stats().Load().DecryptErrors == 0 {
+		t.Fatal("the packet of another secret isn't counted")
+	}
+}
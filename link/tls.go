@@ -3,38 +3,56 @@ package link
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
-	"time"
 
 	"github.com/clmul/cutevpn"
+	"github.com/clmul/cutevpn/encryption"
 )
 
-func newTLS(vpn cutevpn.VPN, linkURL *url.URL, cert tls.Certificate, ca *x509.CertPool) error {
+// newTLS creates a tls link. The listener also serves HTTP links on the
+// http= path of linkURL, whose packets are encrypted by cipher.
+func newTLS(vpn cutevpn.VPN, linkURL *url.URL, creds *credentials, cipher cutevpn.Cipher) error {
+	config, err := parseStreamConfig(linkURL, encryption.Plain{})
+	if err != nil {
+		return err
+	}
 	if linkURL.Hostname() == "" {
-		return newTLSListener(vpn, linkURL, cert, ca)
+		return newTLSListener(vpn, linkURL, creds, config, cipher)
 	}
-	return newTLSDialer(vpn, linkURL, cert, ca)
+	return newTLSDialer(vpn, linkURL, creds, config)
 }
 
-func newTLSListener(vpn cutevpn.VPN, linkURL *url.URL, cert tls.Certificate, ca *x509.CertPool) error {
-	listener, err := tls.Listen("tcp", linkURL.Host, &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		ClientAuth:   tls.VerifyClientCertIfGiven,
-		ClientCAs:    ca,
-		MinVersion:   tls.VersionTLS13,
-		NextProtos:   []string{"http/1.1"},
-	})
+func newTLSListener(vpn cutevpn.VPN, linkURL *url.URL, creds *credentials, config streamConfig, cipher cutevpn.Cipher) error {
+	listener, err := tls.Listen("tcp", linkURL.Host, creds.serverConfig(&tls.Config{
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		MinVersion: tls.VersionTLS13,
+		NextProtos: []string{"http/1.1"},
+	}))
+	if err != nil {
+		return err
+	}
+	query := linkURL.Query()
+	handler, err := newFallbackHandler(query.Get("fallback"))
 	if err != nil {
+		listener.Close()
 		return err
 	}
+	if path := query.Get("http"); path != "" {
+		httpConfig, err := parseHTTPConfig(linkURL, cipher)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		handler = newHTTPServer(vpn, path, httpConfig, "https", handler)
+	}
 	vpn.OnCancel(vpn.Context(), func() {
 		listener.Close()
 	})
-	fake := newFakeListener()
+	fake := newFakeListener(vpn, handler)
 	vpn.Loop(func(ctx context.Context) error {
 		conn, err := listener.Accept()
 		if err != nil {
@@ -47,25 +65,51 @@ func newTLSListener(vpn cutevpn.VPN, linkURL *url.URL, cert tls.Certificate, ca
 		}
 		if len(conn.(*tls.Conn).ConnectionState().VerifiedChains) == 0 {
 			log.Println("response HTTPS")
-			fake.ch <- conn
+			select {
+			case fake.ch <- conn:
+			case <-ctx.Done():
+				conn.Close()
+			}
 			return nil
 		}
-		peer := newStream(ctx, vpn, conn, nil)
+		_, remotePort, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		remote := conn.(*tls.Conn).ConnectionState().PeerCertificates[0].Subject.CommonName
+		remote = fmt.Sprintf("%v:%v", remote, remotePort)
+		peer := newStream(ctx, vpn, conn, newStreamFramer(conn, config.cipher), config, "tls", conn.LocalAddr(), remote, nil)
 		vpn.AddLink(peer)
 		return nil
 	})
 	return nil
 }
 
-func newTLSDialer(vpn cutevpn.VPN, linkURL *url.URL, cert tls.Certificate, ca *x509.CertPool) error {
+func newTLSDialer(vpn cutevpn.VPN, linkURL *url.URL, creds *credentials, config streamConfig) error {
+	dial, err := newDialer(linkURL)
+	if err != nil {
+		return err
+	}
+	servers, err := newEndpoints(linkURL, dial)
+	if err != nil {
+		return err
+	}
 	vpn.Loop(func(ctx context.Context) error {
-		return connect(ctx, vpn, linkURL, cert, ca)
+		return connect(ctx, vpn, func(ctx context.Context) (cutevpn.Link, error) {
+			conn, err := tlsDialContext(ctx, servers, creds.clientConfig(&tls.Config{
+				MinVersion: tls.VersionTLS13,
+				ServerName: linkURL.Hostname(),
+			}))
+			if err != nil {
+				return nil, err
+			}
+			return newStream(ctx, vpn, conn, newStreamFramer(conn, config.cipher), config, "tls", conn.LocalAddr(), linkURL.Host, linkURL.Host), nil
+		})
 	})
 	return nil
 }
 
-func tlsDialContext(ctx context.Context, host string, config *tls.Config) (*tls.Conn, error) {
-	rawConn, err := (&net.Dialer{}).DialContext(ctx, "tcp", host)
+// tlsDialContext connects to one of servers. The certificate of every server
+// is verified with config.ServerName, which is the hostname of the link URL.
+func tlsDialContext(ctx context.Context, servers *endpoints, config *tls.Config) (*tls.Conn, error) {
+	rawConn, err := servers.Dial(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -73,57 +117,35 @@ func tlsDialContext(ctx context.Context, host string, config *tls.Config) (*tls.
 	return conn, nil
 }
 
-func connect(ctx context.Context, vpn cutevpn.VPN, linkURL *url.URL, cert tls.Certificate, ca *x509.CertPool) error {
-	for i := 1; ; i++ {
-		conn, err := tlsDialContext(ctx, linkURL.Host, &tls.Config{
-			Certificates: []tls.Certificate{cert},
-			RootCAs:      ca,
-			MinVersion:   tls.VersionTLS13,
-			ServerName:   linkURL.Hostname(),
-		})
-		if err != nil {
-			log.Println(err)
-			select {
-			case <-time.After(time.Second * 5):
-			case <-vpn.Context().Done():
-				return nil
-			}
-			continue
-		}
-		peer := newStream(ctx, vpn, conn, linkURL.Host)
-		vpn.AddLink(peer)
-		<-peer.Done()
-		return nil
-	}
-}
-
+// fakeListener passes the connections without a verified certificate to
+// an HTTP server, so the listener looks like a website.
 type fakeListener struct {
-	ch chan net.Conn
+	ch  chan net.Conn
+	ctx context.Context
 }
 
-func newFakeListener() *fakeListener {
-	handler := http.NewServeMux()
-	handler.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
-		w.Write([]byte(`<!DOCTYPE html>
-<html lang="en">
-<head>
-    <meta charset="UTF-8">
-    <title>Index Page</title>
-</head>
-<body>
-<h1>Hello, world!</h1>
-</body>
-</html>`))
+func newFakeListener(vpn cutevpn.VPN, handler http.Handler) *fakeListener {
+	ln := &fakeListener{ch: make(chan net.Conn), ctx: vpn.Context()}
+	server := &http.Server{Handler: handler}
+	vpn.OnCancel(vpn.Context(), func() {
+		server.Close()
+	})
+	vpn.Go(func() {
+		err := server.Serve(ln)
+		if err != nil && vpn.Context().Err() == nil {
+			log.Println(err)
+		}
 	})
-	ln := &fakeListener{ch: make(chan net.Conn)}
-	go func() {
-		log.Fatal(http.Serve(ln, handler))
-	}()
 	return ln
 }
 
 func (ln *fakeListener) Accept() (net.Conn, error) {
-	return <-ln.ch, nil
+	select {
+	case conn := <-ln.ch:
+		return conn, nil
+	case <-ln.ctx.Done():
+		return nil, ln.ctx.Err()
+	}
 }
 
 func (ln *fakeListener) Close() error {
@@ -7,65 +7,154 @@ import (
 	"net"
 	"net/url"
 	"strconv"
+	"time"
 
 	"github.com/clmul/cutevpn"
 )
 
 type udp struct {
 	cipher cutevpn.Cipher
+	fec    *fec
+	hop    *hopConfig
 	peer   cutevpn.LinkAddr
-	conn   *net.UDPConn
+	conn   udpConn
+	local  string
+	stats  *cutevpn.LinkStats
+	alive  *keepalive
 	ctx    context.Context
 	cancel context.CancelFunc
 }
 
-func newUDP(vpn cutevpn.VPN, linkURL *url.URL, cipher cutevpn.Cipher) error {
-	ctx, cancel := context.WithCancel(vpn.Context())
-	t := &udp{
+// udpConn is a *net.UDPConn, or a *hopListener which listens on many ports.
+type udpConn interface {
+	ReadFromUDP(buffer []byte) (int, *net.UDPAddr, error)
+	WriteToUDP(packet []byte, addr *net.UDPAddr) (int, error)
+}
+
+type udpConfig struct {
+	cipher    cutevpn.Cipher
+	keepalive time.Duration
+	fec       string
+	hop       *hopConfig
+}
+
+func parseUDPConfig(linkURL *url.URL, cipher cutevpn.Cipher, keys *keySet) (udpConfig, error) {
+	config := udpConfig{
 		cipher: cipher,
-		ctx:    ctx,
-		cancel: cancel,
+		fec:    linkURL.Query().Get("fec"),
+	}
+	var err error
+	config.keepalive, err = parseKeepalive(linkURL)
+	if err != nil {
+		return config, err
+	}
+	_, err = parseFEC(config.fec, nil)
+	if err != nil {
+		return config, err
 	}
+	config.hop, err = parseHop(linkURL, keys)
+	return config, err
+}
 
-	var listen string
+func newUDP(vpn cutevpn.VPN, linkURL *url.URL, cipher cutevpn.Cipher, keys *keySet) error {
+	config, err := parseUDPConfig(linkURL, cipher, keys)
+	if err != nil {
+		return err
+	}
 	if linkURL.Hostname() == "" {
-		listen = linkURL.Host
-	} else {
-		ips, err := net.LookupIP(linkURL.Hostname())
+		_, err := startUDP(vpn, linkURL.Host, nil, config)
+		return err
+	}
+	// The port of a hopping dialer changes, and it's chosen when sending.
+	port := 0
+	if config.hop == nil {
+		port, err = strconv.Atoi(linkURL.Port())
 		if err != nil {
-			return err
-		}
-		if len(ips) == 0 {
-			return fmt.Errorf("known host %v", linkURL.Hostname())
+			return fmt.Errorf("%v is not a valid port", linkURL.Port())
 		}
-		addr := ips[0]
-		port, err := strconv.Atoi(linkURL.Port())
+	}
+	resolve := func(host string) (cutevpn.LinkAddr, error) {
+		ips, err := net.LookupIP(host)
 		if err != nil {
-			return fmt.Errorf("%v is not a valid port", linkURL.Port())
+			return nil, err
+		}
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("known host %v", host)
 		}
-		t.peer = convertNetAddr(addr, port)
+		return convertNetAddr(ips[0], port), nil
 	}
-	c, err := net.ListenPacket("udp", listen)
+	peer, err := resolve(linkURL.Hostname())
 	if err != nil {
 		return err
 	}
-	vpn.OnCancel(ctx, func() {
-		err := c.Close()
+	link, err := startUDP(vpn, "", peer, config)
+	if err != nil {
+		return err
+	}
+	return watchPeer(vpn, linkURL, link, resolve, func(peer cutevpn.LinkAddr) (cutevpn.Link, error) {
+		return startUDP(vpn, "", peer, config)
+	})
+}
+
+// startUDP starts a UDP link. If peer isn't nil, the link is closed after
+// the peer is silent for config.keepalive.
+func startUDP(vpn cutevpn.VPN, listen string, peer cutevpn.LinkAddr, config udpConfig) (*udp, error) {
+	ctx, cancel := context.WithCancel(vpn.Context())
+	t := &udp{
+		cipher: config.cipher,
+		hop:    config.hop,
+		peer:   peer,
+		stats:  new(cutevpn.LinkStats),
+		alive:  newKeepalive(config.keepalive),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	var err error
+	t.fec, err = parseFEC(config.fec, t.write)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if config.hop != nil && peer == nil {
+		host, _, err := net.SplitHostPort(listen)
 		if err != nil {
-			log.Println(err)
+			host = listen
 		}
-	})
-	t.conn = c.(*net.UDPConn)
+		h, err := newHopListener(vpn, ctx, config.hop, host)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		t.conn, t.local = h, h.String()
+	} else {
+		c, err := net.ListenPacket("udp", listen)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		t.conn, t.local = c.(*net.UDPConn), c.LocalAddr().String()
+		vpn.OnCancel(ctx, func() {
+			err := c.Close()
+			if err != nil {
+				log.Println(err)
+			}
+		})
+	}
 	vpn.AddLink(t)
-
-	return nil
+	if peer != nil {
+		t.alive.start(vpn, t)
+	}
+	return t, nil
 }
 
 func (t *udp) ToString(dst cutevpn.LinkAddr) string {
 	if dst == nil {
 		dst = "any"
 	}
-	return fmt.Sprintf("udp %v->%v", t.conn.LocalAddr(), dst)
+	if ap, ok := dst.(AddrPort); ok && t.hop != nil && t.peer != nil {
+		dst = net.JoinHostPort(net.IP(ap.IP[:]).String(), t.hop.String())
+	}
+	return fmt.Sprintf("udp %v->%v", t.local, dst)
 }
 
 func (t *udp) Peer() cutevpn.LinkAddr {
@@ -73,27 +162,69 @@ func (t *udp) Peer() cutevpn.LinkAddr {
 }
 
 func (t *udp) Send(packet []byte, addr cutevpn.LinkAddr) error {
+	if t.fec != nil {
+		return t.fec.Send(packet, addr)
+	}
+	return t.write(packet, addr)
+}
+
+func (t *udp) write(packet []byte, addr cutevpn.LinkAddr) error {
 	ip, port := convertToNetAddr(addr.(AddrPort))
-	_, err := t.conn.WriteToUDP(t.cipher.Encrypt(packet), &net.UDPAddr{IP: ip, Port: port})
+	if t.hop != nil && t.peer != nil {
+		port = t.hop.currentPort()
+	}
+	_, err := t.conn.WriteToUDP(encryptTo(t.cipher, packet, addr), &net.UDPAddr{IP: ip, Port: port})
 	return err
 }
 
 func (t *udp) Recv(packet []byte) (p []byte, addr cutevpn.LinkAddr, err error) {
+	if t.fec != nil {
+		if p, ok := t.fec.Recovered(); ok {
+			return t.received(append(packet[:0], p.payload...), p.src)
+		}
+	}
 	n, udpAddr, err := t.conn.ReadFromUDP(packet)
 	if err != nil {
 		return nil, nil, err
 	}
 	packet = packet[:n]
-	packet, err = t.cipher.Decrypt(packet)
+	addr = convertNetAddr(udpAddr.IP, udpAddr.Port)
+	if t.hop != nil && t.peer != nil {
+		// The peer is the same on every port.
+		addr = t.peer
+	}
+	packet, err = decryptFrom(t.cipher, packet, addr)
 	if err != nil {
+		t.stats.AddDecryptError()
 		log.Println(err)
 		return packet[:0], nil, nil
 	}
-	return packet, convertNetAddr(udpAddr.IP, udpAddr.Port), nil
+	if t.fec != nil {
+		packet, err = t.fec.Decode(packet, addr)
+		if err != nil {
+			log.Println(err)
+			return packet[:0], nil, nil
+		}
+		if packet == nil {
+			return nil, nil, nil
+		}
+	}
+	return t.received(packet, addr)
+}
+
+func (t *udp) received(packet []byte, addr cutevpn.LinkAddr) ([]byte, cutevpn.LinkAddr, error) {
+	if t.alive.received(packet, func(p []byte) error { return t.Send(p, addr) }) {
+		return packet[:0], nil, nil
+	}
+	return packet, addr, nil
 }
 
 func (t *udp) Overhead() int {
-	return 20 + 8 + t.cipher.Overhead()
+	overhead := 20 + 8 + t.cipher.Overhead()
+	if t.fec != nil {
+		overhead += t.fec.Overhead()
+	}
+	return overhead
 }
 
 func (t *udp) Cancel() {
@@ -104,13 +235,17 @@ func (t *udp) Done() <-chan struct{} {
 	return t.ctx.Done()
 }
 
+func (t *udp) Stats() *cutevpn.LinkStats {
+	return t.stats
+}
+
 type AddrPort struct {
 	IP   [16]byte
 	Port int
 }
 
 func (ap AddrPort) String() string {
-	return fmt.Sprintf("%v:%v", net.IP(ap.IP[:]), ap.Port)
+	return net.JoinHostPort(net.IP(ap.IP[:]).String(), strconv.Itoa(ap.Port))
 }
 
 func convertNetAddr(ip net.IP, port int) AddrPort {
@@ -0,0 +1,163 @@
+package link
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/clmul/cutevpn"
+)
+
+// newWebSocket creates a link whose packets are carried in WebSocket messages,
+// so it can pass through HTTP reverse proxies and CDNs.
+func newWebSocket(vpn cutevpn.VPN, linkURL *url.URL, cipher cutevpn.Cipher) error {
+	config, err := parseStreamConfig(linkURL, cipher)
+	if err != nil {
+		return err
+	}
+	if linkURL.Hostname() == "" {
+		return newWebSocketListener(vpn, linkURL, config)
+	}
+	return newWebSocketDialer(vpn, linkURL, config)
+}
+
+func newWebSocketListener(vpn cutevpn.VPN, linkURL *url.URL, config streamConfig) error {
+	listener, err := net.Listen("tcp", linkURL.Host)
+	if err != nil {
+		return err
+	}
+	if linkURL.Scheme == "wss" {
+		query := linkURL.Query()
+		if query.Get("cert") == "" || query.Get("key") == "" {
+			listener.Close()
+			return fmt.Errorf("a wss listener needs cert and key")
+		}
+		creds, err := loadCredentials(vpn, query.Get("cert"), query.Get("key"), "")
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		listener = tls.NewListener(listener, creds.serverConfig(&tls.Config{
+			MinVersion: tls.VersionTLS12,
+		}))
+	}
+	path := linkURL.Path
+	if path == "" {
+		path = "/"
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, websocket.Server{
+		// Any origin is accepted. Peers are authenticated by the cipher.
+		Handshake: func(config *websocket.Config, req *http.Request) error {
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			req := ws.Request()
+			local := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+			peer := newStream(vpn.Context(), vpn, ws, newWSFramer(ws), config, linkURL.Scheme, local, req.RemoteAddr, nil)
+			vpn.AddLink(peer)
+			<-peer.Done()
+		},
+	})
+	server := &http.Server{Handler: mux}
+	vpn.OnCancel(vpn.Context(), func() {
+		server.Close()
+	})
+	vpn.Go(func() {
+		err := server.Serve(listener)
+		if err != http.ErrServerClosed {
+			log.Println(err)
+		}
+	})
+	return nil
+}
+
+func newWebSocketDialer(vpn cutevpn.VPN, linkURL *url.URL, config streamConfig) error {
+	var creds *credentials
+	if linkURL.Scheme == "wss" {
+		var err error
+		creds, err = loadCredentials(vpn, "", "", linkURL.Query().Get("cacert"))
+		if err != nil {
+			return err
+		}
+	}
+	// The query string holds the secret, don't send it to the server.
+	location := *linkURL
+	location.RawQuery = ""
+	origin := url.URL{Scheme: "http", Host: linkURL.Host}
+	if creds != nil {
+		origin.Scheme = "https"
+	}
+	wsConfig, err := websocket.NewConfig(location.String(), origin.String())
+	if err != nil {
+		return err
+	}
+	dial, err := newDialer(linkURL)
+	if err != nil {
+		return err
+	}
+	servers, err := newEndpoints(linkURL, dial)
+	if err != nil {
+		return err
+	}
+	vpn.Loop(func(ctx context.Context) error {
+		return connect(ctx, vpn, func(ctx context.Context) (cutevpn.Link, error) {
+			conn, err := servers.Dial(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if creds != nil {
+				conn = tls.Client(conn, creds.clientConfig(&tls.Config{
+					MinVersion: tls.VersionTLS12,
+					ServerName: linkURL.Hostname(),
+				}))
+			}
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+			ws, err := websocket.NewClient(wsConfig, conn)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return newStream(ctx, vpn, ws, newWSFramer(ws), config, linkURL.Scheme, conn.LocalAddr(), linkURL.Host, linkURL.Host), nil
+		})
+	})
+	return nil
+}
+
+// wsFramer sends every packet as a binary WebSocket message.
+type wsFramer struct {
+	conn *websocket.Conn
+}
+
+func newWSFramer(conn *websocket.Conn) wsFramer {
+	conn.PayloadType = websocket.BinaryFrame
+	conn.MaxPayloadBytes = 2048
+	return wsFramer{conn: conn}
+}
+
+func (f wsFramer) WritePackets(packets [][]byte) error {
+	for _, packet := range packets {
+		_, err := f.conn.Write(packet)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f wsFramer) ReadPacket(buffer []byte) ([]byte, error) {
+	var message []byte
+	err := websocket.Message.Receive(f.conn, &message)
+	if err != nil {
+		return nil, err
+	}
+	n := copy(buffer, message)
+	return buffer[:n], nil
+}
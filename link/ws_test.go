@@ -0,0 +1,7 @@
+package link
+
+import "testing"
+
+func TestWebSocket(t *testing.T) {
+	testReconnect(t, "ws")
+}
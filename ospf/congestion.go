@@ -0,0 +1,52 @@
+package ospf
+
+import (
+	"github.com/clmul/cutevpn"
+)
+
+// congestion is the rate of the packets dropped by a Link,
+// which is reported by the Link in its LinkStats.
+type congestion struct {
+	stats cutevpn.LinkStats
+	// the return value of runtime.nanotime() when stats was loaded
+	t uint64
+	// packets sent per 128 packets accepted by the Link
+	rate uint64
+}
+
+func newCongestion(link cutevpn.Link) *congestion {
+	return &congestion{
+		stats: link.Stats().Load(),
+		t:     nanotime(),
+		rate:  128,
+	}
+}
+
+// update calculates the rate at most once per helloInterval.
+func (c *congestion) update(link cutevpn.Link) {
+	now := nanotime()
+	if now-c.t < uint64(helloInterval) {
+		return
+	}
+	stats := link.Stats().Load()
+	accepted := stats.SentPackets - c.stats.SentPackets
+	dropped := stats.Dropped - c.stats.Dropped
+	if dropped > accepted {
+		dropped = accepted
+	}
+	c.rate = 128
+	if accepted > 0 {
+		c.rate = (accepted - dropped) * 128 / accepted
+	}
+	if c.rate == 0 {
+		c.rate = 1
+	}
+	c.stats = stats
+	c.t = now
+}
+
+// penalize increases rtt like metric.Value does for lost Hello packets,
+// so a congested link attracts less traffic.
+func (c *congestion) penalize(rtt uint64) uint64 {
+	return rtt * 128 / c.rate * 128 / c.rate * 128 / c.rate
+}
@@ -0,0 +1,91 @@
+package ospf
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/clmul/cutevpn"
+)
+
+// testVPN runs the loops of OSPF without links.
+type testVPN struct {
+	ctx context.Context
+	wg  sync.WaitGroup
+}
+
+func (v *testVPN) Name() string              { return "test" }
+func (v *testVPN) Context() context.Context  { return v.ctx }
+func (v *testVPN) AddLink(link cutevpn.Link) {}
+
+func (v *testVPN) Go(f func()) {
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+		f()
+	}()
+}
+
+func (v *testVPN) OnCancel(ctx context.Context, f func()) {
+	v.Go(func() {
+		<-ctx.Done()
+		f()
+	})
+}
+
+func (v *testVPN) Loop(f func(context.Context) error) {
+	v.Go(func() {
+		for v.ctx.Err() == nil && f(v.ctx) == nil {
+		}
+	})
+}
+
+// doneLink is a Link which only has stats, and is done when it's canceled.
+type doneLink struct {
+	cutevpn.Link
+	stats *cutevpn.LinkStats
+	done  chan struct{}
+}
+
+func (l *doneLink) Stats() *cutevpn.LinkStats { return l.stats }
+func (l *doneLink) Done() <-chan struct{}     { return l.done }
+
+func TestCongestionOfLink(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ospf := New(&testVPN{ctx: ctx}, IPv4{10, 0, 0, 1}, false)
+	link := &doneLink{stats: new(cutevpn.LinkStats), done: make(chan struct{})}
+	a, b := cutevpn.Route{Link: link, Addr: "a"}, cutevpn.Route{Link: link, Addr: "b"}
+	run := func(f func()) {
+		done := make(chan struct{})
+		ospf.tasks <- func() {
+			f()
+			close(done)
+		}
+		<-done
+	}
+	run(func() {
+		ospf.updateMetric(IPv4{10, 0, 0, 2}, a, 1, 1000)
+		ospf.updateMetric(IPv4{10, 0, 0, 3}, b, 1, 1000)
+	})
+	hasCongestion := func() (ok bool) {
+		run(func() { _, ok = ospf.congestion[link] })
+		return ok
+	}
+
+	// A dead route doesn't clear the congestion of the routes left on its Link.
+	run(func() { ospf.removeRoute(deadRoute{IPv4{10, 0, 0, 2}, a}) })
+	if !hasCongestion() {
+		t.Fatal("the congestion is removed with a route")
+	}
+
+	close(link.done)
+	deadline := time.Now().Add(time.Second)
+	for hasCongestion() {
+		if time.Now().After(deadline) {
+			t.Fatal("the congestion of a removed link is kept")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
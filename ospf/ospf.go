@@ -46,8 +46,9 @@ type OSPF struct {
 	leaf   bool
 	boot   uint64
 
-	adjacents map[IPv4]*adjacent
-	neighbors map[IPv4]*linkState
+	adjacents  map[IPv4]*adjacent
+	neighbors  map[IPv4]*linkState
+	congestion map[cutevpn.Link]*congestion
 
 	deadRoutes chan deadRoute
 	tasks      chan func()
@@ -85,6 +86,7 @@ func New(vpn cutevpn.VPN, ip IPv4, isLeaf bool) *OSPF {
 		routes:     newRouteTable(),
 		adjacents:  make(map[IPv4]*adjacent),
 		neighbors:  make(map[IPv4]*linkState),
+		congestion: make(map[cutevpn.Link]*congestion),
 		deadRoutes: make(chan deadRoute),
 		tasks:      make(chan func()),
 	}
@@ -132,6 +134,13 @@ func (ospf *OSPF) Neighbors() []Neighbor {
 func (ospf *OSPF) Dump() []byte {
 	result := make(chan []byte)
 	ospf.tasks <- func() {
+		links := make(map[string]cutevpn.LinkStats)
+		for _, adja := range ospf.adjacents {
+			for route := range adja.Routes {
+				link := route.Link
+				links[link.ToString(link.Peer())] = link.Stats().Load()
+			}
+		}
 		ospf.routes.Lock()
 		data, err := json.Marshal(map[string]interface{}{
 			"IP":             ospf.ip,
@@ -139,6 +148,7 @@ func (ospf *OSPF) Dump() []byte {
 			"neighbors":      ospf.neighbors,
 			"adjaRoutes":     ospf.routes.adja,
 			"shortestRoutes": ospf.routes.shortest,
+			"links":          links,
 		})
 		ospf.routes.Unlock()
 		if err != nil {
@@ -233,7 +243,22 @@ func (ospf *OSPF) updateMetric(src IPv4, route cutevpn.Route, bootTime, rtt uint
 		ospf.adjacents[src] = adja
 	}
 	adja.BootTime = bootTime
-	newRoute, needUpdate := adja.Update(route, rtt)
+	c, ok := ospf.congestion[route.Link]
+	if !ok {
+		c = newCongestion(route.Link)
+		ospf.congestion[route.Link] = c
+		// The congestion is shared by the routes of the Link, it's kept until the Link is removed.
+		link := route.Link
+		ospf.vpn.Go(func() {
+			<-link.Done()
+			select {
+			case <-ospf.vpn.Context().Done():
+			case ospf.tasks <- func() { delete(ospf.congestion, link) }:
+			}
+		})
+	}
+	c.update(route.Link)
+	newRoute, needUpdate := adja.Update(route, c.penalize(rtt))
 	if newRoute {
 		ospf.vpn.Go(func() {
 			<-route.Link.Done()
@@ -250,8 +275,12 @@ func (ospf *OSPF) updateMetric(src IPv4, route cutevpn.Route, bootTime, rtt uint
 }
 
 func (ospf *OSPF) removeRoute(dr deadRoute) {
+	adja, ok := ospf.adjacents[dr.adja]
+	if !ok {
+		// The adjacent is removed by checkAdja before its Link.
+		return
+	}
 	log.Printf("remove dead route to %v, %v", dr.adja, dr.route)
-	adja := ospf.adjacents[dr.adja]
 	delete(adja.Routes, dr.route)
 	if len(adja.Routes) == 0 {
 		log.Println("remove dead adjacent", dr.adja)
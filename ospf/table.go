@@ -44,12 +44,27 @@ func (rt *table) getAdja(addr IPv4) (cutevpn.Route, error) {
 		return cutevpn.Route{}, cutevpn.ErrNoRoute
 	}
 	routes := *proutes
-	r := routes[0].R
-	routes[0].current += routes[0].Metric
-	heap.Fix(&routes, 0)
+	i := 0
+	if saturated(routes[0].R) {
+		// Take the next route which isn't saturated, or keep the first if all of them are.
+		for j := 1; j < len(routes); j++ {
+			if !saturated(routes[j].R) && (i == 0 || routes[j].current < routes[i].current) {
+				i = j
+			}
+		}
+	}
+	r := routes[i].R
+	routes[i].current += routes[i].Metric
+	heap.Fix(&routes, i)
 	return r, nil
 }
 
+// saturated reports whether the Link of r is sending at its rate limit.
+func saturated(r cutevpn.Route) bool {
+	limited, ok := r.Link.(cutevpn.RateLimited)
+	return ok && limited.Saturated()
+}
+
 func (rt *table) getShortest(addr IPv4) (cutevpn.Route, error) {
 	next, ok := rt.shortest[addr]
 	if !ok {
@@ -0,0 +1,53 @@
+package ospf
+
+import (
+	"container/heap"
+	"testing"
+
+	"github.com/clmul/cutevpn"
+)
+
+type limitedLink struct {
+	cutevpn.Link
+	saturated bool
+}
+
+func (l *limitedLink) Saturated() bool {
+	return l.saturated
+}
+
+func TestGetAdjaSaturated(t *testing.T) {
+	fast, slow := &limitedLink{}, &limitedLink{}
+	routes := routeHeap{
+		{R: cutevpn.Route{Link: fast}, Metric: 1, current: 1},
+		{R: cutevpn.Route{Link: slow}, Metric: 100, current: 100},
+	}
+	heap.Init(&routes)
+	adja := IPv4{10, 0, 0, 1}
+	rt := newRouteTable()
+	rt.adja[adja] = &routes
+
+	count := func() map[cutevpn.Link]int {
+		n := make(map[cutevpn.Link]int)
+		for i := 0; i < 50; i++ {
+			r, err := rt.getAdja(adja)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n[r.Link]++
+		}
+		return n
+	}
+	if n := count(); n[fast] != 50 {
+		t.Fatalf("the fast link is taken %v times", n[fast])
+	}
+	fast.saturated = true
+	if n := count(); n[slow] != 50 {
+		t.Fatalf("the saturated link is taken %v times", n[fast])
+	}
+	// The saturated link is taken when all the links are saturated.
+	slow.saturated = true
+	if n := count(); n[fast] == 0 {
+		t.Fatal("no route is taken")
+	}
+}
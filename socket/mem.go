@@ -0,0 +1,59 @@
+package socket
+
+import (
+	"sync"
+)
+
+// Mem is a Socket which exchanges packets with channels instead of the OS.
+// It is used with vpn.StartWithSocket to run VPNs in tests.
+type Mem struct {
+	in  chan []byte
+	out chan []byte
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func NewMem() *Mem {
+	return &Mem{
+		in:     make(chan []byte, 16),
+		out:    make(chan []byte, 16),
+		closed: make(chan struct{}),
+	}
+}
+
+// Input passes packet to the VPN as if it was sent by the OS.
+func (m *Mem) Input(packet []byte) {
+	select {
+	case m.in <- packet:
+	case <-m.closed:
+	}
+}
+
+// Output returns the packets which the VPN sends to the OS.
+func (m *Mem) Output() <-chan []byte {
+	return m.out
+}
+
+func (m *Mem) Send(packet []byte) {
+	select {
+	case m.out <- append([]byte(nil), packet...):
+	default:
+	}
+}
+
+func (m *Mem) Recv(packet []byte) int {
+	select {
+	case p := <-m.in:
+		return copy(packet, p)
+	case <-m.closed:
+		return 0
+	}
+}
+
+func (m *Mem) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.closed)
+	})
+	return nil
+}
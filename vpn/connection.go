@@ -61,9 +61,11 @@ func (c *conn) AddLink(link cutevpn.Link) {
 			link.Cancel()
 			return cutevpn.ErrStopLoop
 		}
-		if len(payload) == 0 {
+		// A packet of the tail only is a signal of the link, like a keepalive.
+		if len(payload) <= tailSize {
 			return nil
 		}
+		link.Stats().AddRecv(len(payload))
 
 		payload, tail := payload[:len(payload)-tailSize], payload[len(payload)-tailSize:]
 		p := packet{
@@ -105,9 +107,17 @@ func (c *conn) Send(p packet) {
 	payload := append(p.payload, tail[:]...)
 
 	route := p.route
-	err := route.Link.Send(payload, route.Addr)
+	var err error
+	if l, ok := route.Link.(cutevpn.ControlSender); ok && p.flags&flagRouting != 0 {
+		err = l.SendControl(payload, route.Addr)
+	} else {
+		err = route.Link.Send(payload, route.Addr)
+	}
 	if err != nil {
+		route.Link.Stats().AddSendError()
 		log.Println(err)
 		route.Link.Cancel()
+		return
 	}
+	route.Link.Stats().AddSent(len(payload))
 }
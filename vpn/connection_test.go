@@ -0,0 +1,58 @@
+package vpn
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/clmul/cutevpn"
+)
+
+// chanLink receives the packets of in, and sends nothing.
+type chanLink struct {
+	in     chan []byte
+	stats  *cutevpn.LinkStats
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (l *chanLink) Send(packet []byte, dst cutevpn.LinkAddr) error { return nil }
+func (l *chanLink) Recv(buffer []byte) ([]byte, cutevpn.LinkAddr, error) {
+	select {
+	case <-l.ctx.Done():
+		return nil, nil, l.ctx.Err()
+	case p := <-l.in:
+		return append(buffer[:0], p...), "peer", nil
+	}
+}
+func (l *chanLink) Peer() cutevpn.LinkAddr               { return nil }
+func (l *chanLink) Overhead() int                        { return 0 }
+func (l *chanLink) ToString(dst cutevpn.LinkAddr) string { return "chan" }
+func (l *chanLink) Cancel()                              { l.cancel() }
+func (l *chanLink) Done() <-chan struct{}                { return l.ctx.Done() }
+func (l *chanLink) Stats() *cutevpn.LinkStats            { return l.stats }
+
+func TestConnRecvStats(t *testing.T) {
+	vpn := NewVPN("test")
+	defer vpn.Stop()
+	c := newConn(vpn)
+	ctx, cancel := context.WithCancel(vpn.Context())
+	link := &chanLink{in: make(chan []byte), stats: new(cutevpn.LinkStats), ctx: ctx, cancel: cancel}
+	c.AddLink(link)
+
+	// The signals of the link aren't counted as traffic.
+	link.in <- make([]byte, tailSize)
+	link.in <- make([]byte, 100+tailSize)
+	select {
+	case p := <-c.queue:
+		if len(p.payload) != 100 {
+			t.Fatalf("the payload has %v bytes", len(p.payload))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the packet isn't received")
+	}
+	stats := link.Stats().Load()
+	if stats.RecvPackets != 1 || stats.RecvBytes != 100+tailSize {
+		t.Fatalf("%v packets of %v bytes are received", stats.RecvPackets, stats.RecvBytes)
+	}
+}
@@ -1,6 +1,7 @@
 package vpn
 
 import (
+	"encoding/json"
 	"log"
 	"math/rand"
 	"net/http"
@@ -12,7 +13,8 @@ type httpServer struct {
 	*http.ServeMux
 }
 
-func (h httpServer) RegisterHandler(router *router) {
+func (h httpServer) RegisterHandler(v *VPN) {
+	router := v.router
 	h.HandleFunc("/debug/ospf", func(w http.ResponseWriter, req *http.Request) {
 		ospf := router.routing.Dump()
 		_, err := w.Write(ospf)
@@ -20,6 +22,18 @@ func (h httpServer) RegisterHandler(router *router) {
 			log.Println(err)
 		}
 	})
+	h.HandleFunc("/debug/links", func(w http.ResponseWriter, req *http.Request) {
+		data, err := json.Marshal(v.LinkStats())
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, err = w.Write(data)
+		if err != nil {
+			log.Println(err)
+		}
+	})
 	h.HandleFunc("/debug/speedtest", func(w http.ResponseWriter, req *http.Request) {
 		buf := make([]byte, 1024*512)
 		rand.Read(buf)
@@ -41,6 +55,8 @@ func (h httpServer) RegisterHandler(router *router) {
 
 <a href="/debug/ospf">OSPF</a>
 <br/>
+<a href="/debug/links">Links</a>
+<br/>
 <a href="/debug/pprof">net/http/pprof</a>
 
 </body>
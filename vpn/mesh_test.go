@@ -0,0 +1,80 @@
+package vpn
+
+import (
+	"testing"
+	"time"
+
+	"github.com/clmul/cutevpn"
+	"github.com/clmul/cutevpn/socket"
+)
+
+type testNode struct {
+	vpn    *VPN
+	socket *socket.Mem
+	ip     cutevpn.IPv4
+}
+
+func startTestNode(t *testing.T, name, cidr string, links ...string) testNode {
+	t.Helper()
+	conf := &cutevpn.Config{
+		Name:  name,
+		CIDR:  cidr,
+		Links: links,
+	}
+	ip, _, err := cutevpn.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vpn := NewVPN(name)
+	sock := socket.NewMem()
+	vpn.OnCancel(vpn.Context(), func() {
+		sock.Close()
+	})
+	err = StartWithSocket(conf, vpn, sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(vpn.Stop)
+	return testNode{vpn: vpn, socket: sock, ip: ip}
+}
+
+func testPacket(src, dst cutevpn.IPv4, payload string) []byte {
+	p := make([]byte, 20, 20+len(payload))
+	p[0] = 0x45
+	p[8] = 64
+	copy(p[12:16], src[:])
+	copy(p[16:20], dst[:])
+	return append(p, payload...)
+}
+
+// TestMesh routes packets through a chain of three VPNs connected by mem links.
+func TestMesh(t *testing.T) {
+	a := startTestNode(t, "a", "10.200.0.1/24", "mem://mesh-ab?secret=255a5b9021450fe59c4712f0e19c9607")
+	startTestNode(t, "b", "10.200.0.2/24", "mem://mesh-ab?secret=255a5b9021450fe59c4712f0e19c9607", "mem://mesh-bc")
+	c := startTestNode(t, "c", "10.200.0.3/24", "mem://mesh-bc")
+
+	timeout := time.After(20 * time.Second)
+	tick := time.NewTicker(500 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		a.socket.Input(testPacket(a.ip, c.ip, "ping"))
+		select {
+		case p := <-c.socket.Output():
+			if cutevpn.GetSrcIP(p) != a.ip || string(p[20:]) != "ping" {
+				t.Fatalf("wrong packet %v", p)
+			}
+			if p[8] != 63 {
+				t.Errorf("expect TTL 63, got %v", p[8])
+			}
+			for name, stats := range c.vpn.LinkStats() {
+				if stats.RecvPackets == 0 || stats.SentPackets == 0 {
+					t.Errorf("link %v has no traffic, %+v", name, stats)
+				}
+			}
+			return
+		case <-timeout:
+			t.Fatal("packet is not delivered")
+		case <-tick.C:
+		}
+	}
+}
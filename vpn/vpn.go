@@ -22,6 +22,9 @@ type VPN struct {
 	router  *router
 	routing *ospf.OSPF
 
+	linksLock sync.Mutex
+	links     map[cutevpn.Link]struct{}
+
 	http httpServer
 }
 
@@ -31,6 +34,7 @@ func NewVPN(name string) *VPN {
 		name:   name,
 		ctx:    ctx,
 		cancel: cancel,
+		links:  make(map[cutevpn.Link]struct{}),
 	}
 }
 
@@ -39,6 +43,18 @@ func (v *VPN) Name() string {
 }
 
 func (v *VPN) AddLink(link cutevpn.Link) {
+	v.linksLock.Lock()
+	v.links[link] = struct{}{}
+	v.linksLock.Unlock()
+	v.Go(func() {
+		select {
+		case <-link.Done():
+		case <-v.ctx.Done():
+		}
+		v.linksLock.Lock()
+		delete(v.links, link)
+		v.linksLock.Unlock()
+	})
 	v.conn.AddLink(link)
 	peer := link.Peer()
 	if peer != nil {
@@ -53,7 +69,7 @@ func (v *VPN) Stop() {
 
 func (v *VPN) StartHTTP(addr string) {
 	v.http = startHTTPServer(addr)
-	v.http.RegisterHandler(v.router)
+	v.http.RegisterHandler(v)
 }
 
 func (v *VPN) StopHTTP() {
@@ -63,6 +79,17 @@ func (v *VPN) StopHTTP() {
 	}
 }
 
+// LinkStats returns the traffic counters of the links, keyed by their names.
+func (v *VPN) LinkStats() map[string]cutevpn.LinkStats {
+	v.linksLock.Lock()
+	defer v.linksLock.Unlock()
+	stats := make(map[string]cutevpn.LinkStats, len(v.links))
+	for link := range v.links {
+		stats[link.ToString(link.Peer())] = link.Stats().Load()
+	}
+	return stats
+}
+
 // used by Android app
 func (v *VPN) UpdateGateway(gateway string) {
 	v.router.gatewayUpdateCh <- gateway